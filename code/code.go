@@ -64,6 +64,29 @@ const (
 	CLASS
 
 	BUILTIN
+
+	LEN
+	ITER
+
+	JUMP_TRUE
+
+	POP
+	DUP
+	SWAP
+
+	CURRENT_CLOSURE
+
+	STORE_FREE
+	CAPTURE_LOCAL
+	CAPTURE_FREE
+
+	THROW
+	SETUP_TRY
+	POP_TRY
+
+	CALL_KW
+	TAIL_CALL
+	DEFINE_LOCAL
 )
 
 type Instruction struct {
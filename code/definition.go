@@ -0,0 +1,131 @@
+package code
+
+import "fmt"
+
+// Variable marks a stack effect which depends on the operands, or on the called function.
+const Variable = -1
+
+// Definition describes how an opcode is encoded, and how it affects the stack.
+type Definition struct {
+	Name string
+	// OperandWidths holds the size in bytes of each operand, in the fixed width encoding (FENCY version 1).
+	OperandWidths []int
+	Pops          int
+	Pushes        int
+}
+
+var definitions = map[Op]*Definition{
+	PUSH: {"PUSH", []int{2}, 0, 1},
+
+	ADD_INT: {"ADD_INT", []int{}, 2, 1},
+	SUB_INT: {"SUB_INT", []int{}, 2, 1},
+	MUL_INT: {"MUL_INT", []int{}, 2, 1},
+	DIV_INT: {"DIV_INT", []int{}, 2, 1},
+
+	LT_INT:  {"LT_INT", []int{}, 2, 1},
+	LTE_INT: {"LTE_INT", []int{}, 2, 1},
+	GT_INT:  {"GT_INT", []int{}, 2, 1},
+	GTE_INT: {"GTE_INT", []int{}, 2, 1},
+
+	ADD_FLOAT: {"ADD_FLOAT", []int{}, 2, 1},
+	SUB_FLOAT: {"SUB_FLOAT", []int{}, 2, 1},
+	MUL_FLOAT: {"MUL_FLOAT", []int{}, 2, 1},
+	DIV_FLOAT: {"DIV_FLOAT", []int{}, 2, 1},
+
+	AND_BOOL: {"AND_BOOL", []int{}, 2, 1},
+	OR_BOOL:  {"OR_BOOL", []int{}, 2, 1},
+
+	EQ:  {"EQ", []int{}, 2, 1},
+	NEQ: {"NEQ", []int{}, 2, 1},
+
+	LT_FLOAT:  {"LT_FLOAT", []int{}, 2, 1},
+	LTE_FLOAT: {"LTE_FLOAT", []int{}, 2, 1},
+	GT_FLOAT:  {"GT_FLOAT", []int{}, 2, 1},
+	GTE_FLOAT: {"GTE_FLOAT", []int{}, 2, 1},
+
+	ADD_STRING: {"ADD_STRING", []int{}, 2, 1},
+
+	JUMP:       {"JUMP", []int{2}, 0, 0},
+	JUMP_FALSE: {"JUMP_FALSE", []int{2}, 1, 0},
+	JUMP_TRUE:  {"JUMP_TRUE", []int{2}, 1, 0},
+
+	RETURN:       {"RETURN", []int{}, 0, 0},
+	RETURN_VALUE: {"RETURN_VALUE", []int{}, 1, 0},
+	// Builtins returning null push nothing.
+	CALL: {"CALL", []int{2}, Variable, Variable},
+	// The operands are the number of positional arguments, and the constant holding the names of the keyword arguments.
+	CALL_KW: {"CALL_KW", []int{2, 2}, Variable, Variable},
+	// Calls reuse the frame of the caller, unless the callee is a builtin.
+	TAIL_CALL: {"TAIL_CALL", []int{2}, Variable, Variable},
+	// Binds a new variable to the slot, set to null. A variable captured from the slot keeps its cell.
+	DEFINE_LOCAL: {"DEFINE_LOCAL", []int{2}, 0, 0},
+
+	STORE_GLOBAL: {"STORE_GLOBAL", []int{2}, 1, 0},
+	STORE_LOCAL:  {"STORE_LOCAL", []int{2}, 1, 0},
+	STORE_FREE:   {"STORE_FREE", []int{2}, 1, 0},
+	LOAD_GLOBAL:  {"LOAD_GLOBAL", []int{2}, 0, 1},
+	LOAD_LOCAL:   {"LOAD_LOCAL", []int{2}, 0, 1},
+	LOAD_FREE:    {"LOAD_FREE", []int{2}, 0, 1},
+
+	// Pops the free variables, preceded by the defaults of the optional parameters of the function.
+	CLOSURE:         {"CLOSURE", []int{2, 2}, Variable, 1},
+	CURRENT_CLOSURE: {"CURRENT_CLOSURE", []int{}, 0, 1},
+	CAPTURE_LOCAL:   {"CAPTURE_LOCAL", []int{2}, 0, 1},
+	CAPTURE_FREE:    {"CAPTURE_FREE", []int{2}, 0, 1},
+
+	ARRAY:  {"ARRAY", []int{2}, Variable, 1},
+	HASH:   {"HASH", []int{2}, Variable, 1},
+	INDEX:  {"INDEX", []int{}, 2, 1},
+	ACCESS: {"ACCESS", []int{}, 2, 1},
+	LEN:    {"LEN", []int{}, 1, 1},
+	ITER:   {"ITER", []int{}, 1, 1},
+
+	NOT:          {"NOT", []int{}, 1, 1},
+	NEGATE_INT:   {"NEGATE_INT", []int{}, 1, 1},
+	NEGATE_FLOAT: {"NEGATE_FLOAT", []int{}, 1, 1},
+	TO_FLOAT:     {"TO_FLOAT", []int{}, 1, 1},
+
+	CLASS:   {"CLASS", []int{}, 1, 1},
+	BUILTIN: {"BUILTIN", []int{2}, 0, 1},
+
+	POP:  {"POP", []int{}, 1, 0},
+	DUP:  {"DUP", []int{}, 1, 2},
+	SWAP: {"SWAP", []int{}, 2, 2},
+
+	THROW:     {"THROW", []int{}, 1, 0},
+	SETUP_TRY: {"SETUP_TRY", []int{2}, 0, 0},
+	POP_TRY:   {"POP_TRY", []int{}, 0, 0},
+}
+
+func Lookup(op Op) (*Definition, error) {
+	def, ok := definitions[op]
+	if !ok {
+		return nil, fmt.Errorf("Opcode %d undefined", op)
+	}
+
+	return def, nil
+}
+
+// StackEffect returns the number of values the instruction pops and pushes, resolving the effects which depend on the operands.
+// Variable remains for what depends on the called function, or on the constant pool.
+func StackEffect(ins Instruction) (int, int, error) {
+	def, err := Lookup(ins.OpCode)
+	if err != nil {
+		return 0, 0, err
+	}
+	if len(ins.Args) != len(def.OperandWidths) {
+		return 0, 0, fmt.Errorf("Expected %d operands for %s, got %d", len(def.OperandWidths), ins.OpCode, len(ins.Args))
+	}
+
+	switch ins.OpCode {
+	case ARRAY:
+		return ins.Args[0], def.Pushes, nil
+	case HASH:
+		return 2 * ins.Args[0], def.Pushes, nil
+	case CALL, TAIL_CALL:
+		// The arguments and the callee.
+		return ins.Args[0] + 1, def.Pushes, nil
+	}
+
+	return def.Pops, def.Pushes, nil
+}
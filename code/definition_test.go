@@ -0,0 +1,52 @@
+package code
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/alecthomas/assert/v2"
+)
+
+func TestEveryOpDefined(t *testing.T) {
+	count := 0
+	for op := Op(1); !strings.HasPrefix(op.String(), "Op("); op++ {
+		count++
+
+		def, err := Lookup(op)
+		assert.NoError(t, err, "No definition for %s", op)
+		assert.Equal(t, op.String(), def.Name, "Definition name not matching.")
+	}
+
+	assert.Equal(t, count, len(definitions), "Definitions for unknown opcodes.")
+}
+
+func TestStackEffect(t *testing.T) {
+	tests := []struct {
+		ins    Instruction
+		pops   int
+		pushes int
+	}{
+		{Instruction{OpCode: ADD_INT}, 2, 1},
+		{Instruction{OpCode: ARRAY, Args: []int{3}}, 3, 1},
+		{Instruction{OpCode: HASH, Args: []int{2}}, 4, 1},
+		{Instruction{OpCode: CLOSURE, Args: []int{7, 2}}, Variable, 1},
+		{Instruction{OpCode: CALL, Args: []int{2}}, 3, Variable},
+		{Instruction{OpCode: TAIL_CALL, Args: []int{0}}, 1, Variable},
+		{Instruction{OpCode: CALL_KW, Args: []int{1, 4}}, Variable, Variable},
+	}
+
+	for _, test := range tests {
+		pops, pushes, err := StackEffect(test.ins)
+		assert.NoError(t, err)
+		assert.Equal(t, test.pops, pops, "Pops of %s", test.ins.OpCode)
+		assert.Equal(t, test.pushes, pushes, "Pushes of %s", test.ins.OpCode)
+	}
+
+	_, _, err := StackEffect(Instruction{OpCode: ARRAY})
+	assert.EqualError(t, err, "Expected 1 operands for ARRAY, got 0")
+}
+
+func TestLookupUndefined(t *testing.T) {
+	_, err := Lookup(Op(255))
+	assert.EqualError(t, err, "Opcode 255 undefined")
+}
@@ -51,11 +51,27 @@ func _() {
 	_ = x[TO_FLOAT-41]
 	_ = x[CLASS-42]
 	_ = x[BUILTIN-43]
+	_ = x[LEN-44]
+	_ = x[ITER-45]
+	_ = x[JUMP_TRUE-46]
+	_ = x[POP-47]
+	_ = x[DUP-48]
+	_ = x[SWAP-49]
+	_ = x[CURRENT_CLOSURE-50]
+	_ = x[STORE_FREE-51]
+	_ = x[CAPTURE_LOCAL-52]
+	_ = x[CAPTURE_FREE-53]
+	_ = x[THROW-54]
+	_ = x[SETUP_TRY-55]
+	_ = x[POP_TRY-56]
+	_ = x[CALL_KW-57]
+	_ = x[TAIL_CALL-58]
+	_ = x[DEFINE_LOCAL-59]
 }
 
-const _Op_name = "PUSHADD_INTSUB_INTMUL_INTDIV_INTLT_INTLTE_INTGT_INTGTE_INTADD_FLOATSUB_FLOATMUL_FLOATDIV_FLOATAND_BOOLOR_BOOLEQNEQLT_FLOATLTE_FLOATGT_FLOATGTE_FLOATADD_STRINGJUMPJUMP_FALSERETURNRETURN_VALUECALLSTORE_GLOBALSTORE_LOCALLOAD_GLOBALLOAD_LOCALLOAD_FREECLOSUREARRAYHASHINDEXACCESSNOTNEGATE_INTNEGATE_FLOATTO_FLOATCLASSBUILTIN"
+const _Op_name = "PUSHADD_INTSUB_INTMUL_INTDIV_INTLT_INTLTE_INTGT_INTGTE_INTADD_FLOATSUB_FLOATMUL_FLOATDIV_FLOATAND_BOOLOR_BOOLEQNEQLT_FLOATLTE_FLOATGT_FLOATGTE_FLOATADD_STRINGJUMPJUMP_FALSERETURNRETURN_VALUECALLSTORE_GLOBALSTORE_LOCALLOAD_GLOBALLOAD_LOCALLOAD_FREECLOSUREARRAYHASHINDEXACCESSNOTNEGATE_INTNEGATE_FLOATTO_FLOATCLASSBUILTINLENITERJUMP_TRUEPOPDUPSWAPCURRENT_CLOSURESTORE_FREECAPTURE_LOCALCAPTURE_FREETHROWSETUP_TRYPOP_TRYCALL_KWTAIL_CALLDEFINE_LOCAL"
 
-var _Op_index = [...]uint16{0, 4, 11, 18, 25, 32, 38, 45, 51, 58, 67, 76, 85, 94, 102, 109, 111, 114, 122, 131, 139, 148, 158, 162, 172, 178, 190, 194, 206, 217, 228, 238, 247, 254, 259, 263, 268, 274, 277, 287, 299, 307, 312, 319}
+var _Op_index = [...]uint16{0, 4, 11, 18, 25, 32, 38, 45, 51, 58, 67, 76, 85, 94, 102, 109, 111, 114, 122, 131, 139, 148, 158, 162, 172, 178, 190, 194, 206, 217, 228, 238, 247, 254, 259, 263, 268, 274, 277, 287, 299, 307, 312, 319, 322, 326, 335, 338, 341, 345, 360, 370, 383, 395, 400, 409, 416, 423, 432, 444}
 
 func (i Op) String() string {
 	idx := int(i) - 1
@@ -0,0 +1,52 @@
+package code
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Position is a location in the source code.
+type Position struct {
+	File string
+	Line int
+	Col  int
+}
+
+func (p Position) IsValid() bool {
+	return p.Line > 0
+}
+
+func (p Position) String() string {
+	if p.File == "" {
+		return fmt.Sprintf("%d:%d", p.Line, p.Col)
+	}
+	return fmt.Sprintf("%s:%d:%d", p.File, p.Line, p.Col)
+}
+
+type LineEntry struct {
+	Offset   int
+	Position Position
+}
+
+// LineTable maps instruction offsets to source positions.
+// An entry is only recorded where the position changes, it applies to every following instruction.
+type LineTable []LineEntry
+
+// Add records the position of the instruction at offset, if it differs from the previous one.
+func (t *LineTable) Add(offset int, pos Position) {
+	if n := len(*t); n > 0 && (*t)[n-1].Position == pos {
+		return
+	}
+	*t = append(*t, LineEntry{Offset: offset, Position: pos})
+}
+
+// Lookup returns the position of the instruction at offset.
+func (t LineTable) Lookup(offset int) (Position, bool) {
+	i := sort.Search(len(t), func(i int) bool {
+		return t[i].Offset > offset
+	})
+	if i == 0 {
+		return Position{}, false
+	}
+	return t[i-1].Position, true
+}
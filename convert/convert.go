@@ -2,11 +2,14 @@ package convert
 
 import (
 	"encoding/binary"
+	"errors"
+	"fmt"
 	"math"
+	"math/bits"
 
 	"github.com/pspiagicw/fenc/code"
+	"github.com/pspiagicw/fenc/emitter"
 	"github.com/pspiagicw/fenc/object"
-	"github.com/pspiagicw/goreland"
 )
 
 type ConstKind int
@@ -18,85 +21,157 @@ const (
 	String
 	Bool
 	Function
+	Array
 )
 
-var operandMap = map[code.Op]int{
-	code.PUSH:         1,
-	code.JUMP:         1,
-	code.JUMP_FALSE:   1,
-	code.CALL:         1,
-	code.STORE_GLOBAL: 1,
-	code.LOAD_GLOBAL:  1,
-	code.LOAD_LOCAL:   1,
-	code.STORE_LOCAL:  1,
-	code.LOAD_FREE:    1,
-	code.CLOSURE:      2,
+var ErrUnsupportedConstant = errors.New("Unsupported constant")
+
+// ConstantError reports a constant of the pool, which can't be serialized.
+type ConstantError struct {
+	Index    int
+	Constant object.Object
+	Err      error
 }
 
-func Convert(instructions []code.Instruction, constants []object.Object) []byte {
+func (e *ConstantError) Error() string {
+	return fmt.Sprintf("Unable to serialize constant %d: %v", e.Index, e.Err)
+}
+func (e *ConstantError) Unwrap() error {
+	return e.Err
+}
+
+// InstructionError reports an instruction, which can't be serialized.
+// Offset is the position of the instruction on the tape.
+type InstructionError struct {
+	Offset int
+	Op     code.Op
+	Err    error
+}
+
+func (e *InstructionError) Error() string {
+	return fmt.Sprintf("Unable to serialize instruction %d (%s): %v", e.Offset, e.Op, e.Err)
+}
+func (e *InstructionError) Unwrap() error {
+	return e.Err
+}
+
+// Version is the version of the FENCY format written by Convert.
+// Version 1 used fixed width fields, version 2 uses varints for integers, operands, counts and lengths.
+// Version 2 also stores null and array constants, and the metadata of functions: their name, parameters and number of locals.
+const Version = 2
+
+// Convert writes the constants, the instructions and the builtin table, if the program references builtins.
+// Unlike an Encoder, it never writes the debug section.
+func Convert(bytecode emitter.ByteCode) ([]byte, error) {
 
 	buffer := []byte{}
 
 	buffer = append(buffer, []byte("FENCY")...)
-	buffer = append(buffer, byte(1))
+	buffer = append(buffer, byte(Version))
 
-	constBytecode := ConvertConstants(constants)
-	actualBytecode := ConvertBytecode(instructions)
-	insLength := uint32(len(actualBytecode))
+	constBytecode, err := ConvertConstants(bytecode.Constants)
+	if err != nil {
+		return nil, err
+	}
+	actualBytecode, err := ConvertBytecode(bytecode.Tape)
+	if err != nil {
+		return nil, err
+	}
 
 	buffer = append(buffer, constBytecode...)
-	buffer = binary.BigEndian.AppendUint32(buffer, insLength)
+	buffer = binary.AppendUvarint(buffer, uint64(len(actualBytecode)))
 	buffer = append(buffer, actualBytecode...)
 
-	return buffer
+	if len(bytecode.Builtins) != 0 {
+		buffer = append(buffer, builtinSection)
+		buffer = binary.AppendUvarint(buffer, uint64(len(bytecode.Builtins)))
+		for _, name := range bytecode.Builtins {
+			buffer = appendString(buffer, name)
+		}
+	}
+
+	return buffer, nil
 }
 
-func ConvertConstants(constants []object.Object) []byte {
+func ConvertConstants(constants []object.Object) ([]byte, error) {
 
 	buffer := []byte{}
 
 	// Append number of constants
-	buffer = binary.BigEndian.AppendUint16(buffer, uint16(len(constants)))
-
-	for _, constant := range constants {
-		switch constant := constant.(type) {
-		case object.Int:
-			buffer = convertInt(buffer, constant)
-		case object.Bool:
-			buffer = convertBool(buffer, constant)
-		case object.Float:
-			buffer = convertFloat(buffer, constant)
-		case object.String:
-			buffer = convertString(buffer, constant)
-		case object.Function:
-			buffer = convertFunction(buffer, constant)
-		default:
-			goreland.LogFatal("Unable to serialize constant: %v", constant)
+	buffer = binary.AppendUvarint(buffer, uint64(len(constants)))
 
+	for i, constant := range constants {
+		var err error
+		buffer, err = convertConstant(buffer, constant)
+		if err != nil {
+			return nil, &ConstantError{Index: i, Constant: constant, Err: err}
 		}
 	}
 
-	return buffer
+	return buffer, nil
 }
-func convertFunction(buffer []byte, constant object.Function) []byte {
-	instructions := ConvertBytecode(constant.Value)
-	insLength := uint16(len(instructions))
+func convertConstant(buffer []byte, constant object.Object) ([]byte, error) {
+	switch constant := constant.(type) {
+	case object.Int:
+		return convertInt(buffer, constant), nil
+	case object.Bool:
+		return convertBool(buffer, constant), nil
+	case object.Float:
+		return convertFloat(buffer, constant), nil
+	case object.String:
+		return convertString(buffer, constant), nil
+	case object.Function:
+		return convertFunction(buffer, constant)
+	case object.Array:
+		return convertArray(buffer, constant)
+	case object.Null:
+		return append(buffer, byte(None)), nil
+	default:
+		return nil, fmt.Errorf("%w: %T", ErrUnsupportedConstant, constant)
+	}
+}
+func convertArray(buffer []byte, constant object.Array) ([]byte, error) {
+	buffer = append(buffer, byte(Array))
+	buffer = binary.AppendUvarint(buffer, uint64(len(constant.Values)))
+
+	for i, value := range constant.Values {
+		var err error
+		buffer, err = convertConstant(buffer, value)
+		if err != nil {
+			return nil, fmt.Errorf("Element %d: %w", i, err)
+		}
+	}
+
+	return buffer, nil
+}
+func convertFunction(buffer []byte, constant object.Function) ([]byte, error) {
+	instructions, err := ConvertBytecode(constant.Value)
+	if err != nil {
+		return nil, err
+	}
 
 	buffer = append(buffer, byte(Function))
-	buffer = binary.BigEndian.AppendUint16(buffer, insLength)
+	buffer = appendString(buffer, constant.Name)
+	buffer = binary.AppendUvarint(buffer, uint64(constant.Arity))
+	buffer = binary.AppendUvarint(buffer, uint64(constant.Optional))
+	buffer = appendBool(buffer, constant.Rest)
+	buffer = binary.AppendUvarint(buffer, uint64(len(constant.Params)))
+	for _, param := range constant.Params {
+		buffer = appendString(buffer, param)
+	}
+	buffer = binary.AppendUvarint(buffer, uint64(constant.NumLocals))
+	buffer = binary.AppendUvarint(buffer, uint64(len(instructions)))
 	buffer = append(buffer, instructions...)
 
-	return buffer
+	return buffer, nil
 }
 func convertString(buffer []byte, constant object.String) []byte {
-	length := uint16(len(constant.Value))
-	strBytes := []byte(constant.Value)
-
 	buffer = append(buffer, byte(String))
-	buffer = binary.BigEndian.AppendUint16(buffer, length)
-	buffer = append(buffer, strBytes...)
-
-	return buffer
+	return appendString(buffer, constant.Value)
+}
+func appendString(buffer []byte, value string) []byte {
+	buffer = binary.AppendUvarint(buffer, uint64(len(value)))
+	return append(buffer, value...)
 }
 func convertFloat(buffer []byte, constant object.Float) []byte {
 	val := math.Float32bits(constant.Value)
@@ -107,49 +182,81 @@ func convertFloat(buffer []byte, constant object.Float) []byte {
 }
 func convertInt(buffer []byte, constant object.Int) []byte {
 	buffer = append(buffer, byte(Int))
-	buffer = binary.BigEndian.AppendUint32(buffer, uint32(constant.Value))
+	buffer = binary.AppendVarint(buffer, int64(constant.Value))
 	return buffer
 }
 
 func convertBool(buffer []byte, constant object.Bool) []byte {
 	buffer = append(buffer, byte(Bool))
-	if constant.Value {
-		buffer = append(buffer, byte(1))
-	} else {
-		buffer = append(buffer, byte(0))
+	return appendBool(buffer, constant.Value)
+}
+func appendBool(buffer []byte, value bool) []byte {
+	if value {
+		return append(buffer, byte(1))
 	}
-	return buffer
+	return append(buffer, byte(0))
 }
-func ConvertBytecode(tape []code.Instruction) []byte {
+func ConvertBytecode(tape []code.Instruction) ([]byte, error) {
 	buffer := []byte{}
-	for _, ins := range tape {
-		args, ok := operandMap[ins.OpCode]
-		if !ok {
-			args = 0
+	for i, ins := range tape {
+		var err error
+		buffer, err = convertInstruction(buffer, i, ins)
+		if err != nil {
+			return nil, err
 		}
-		switch args {
-		case 0:
-			buffer = convertOp(buffer, ins)
-		case 1:
-			buffer = convertOp(buffer, ins)
-			buffer = convertArg(buffer, ins.Args[0])
-		case 2:
-			buffer = convertOp(buffer, ins)
-			buffer = convertArg(buffer, ins.Args[0])
-			buffer = convertArg(buffer, ins.Args[1])
-		default:
-			goreland.LogFatal("Unknown number of operands!")
+	}
+
+	return buffer, nil
+}
+func convertInstruction(buffer []byte, offset int, ins code.Instruction) ([]byte, error) {
+	err := checkInstruction(offset, ins)
+	if err != nil {
+		return nil, err
+	}
+
+	return appendInstruction(buffer, ins), nil
+}
+
+// checkInstruction reports an error, if the instruction can't be encoded.
+func checkInstruction(offset int, ins code.Instruction) error {
+	def, err := code.Lookup(ins.OpCode)
+	if err != nil {
+		return &InstructionError{Offset: offset, Op: ins.OpCode, Err: err}
+	}
+	if len(ins.Args) != len(def.OperandWidths) {
+		err := fmt.Errorf("Expected %d operands, got %d", len(def.OperandWidths), len(ins.Args))
+		return &InstructionError{Offset: offset, Op: ins.OpCode, Err: err}
+	}
+
+	for _, arg := range ins.Args {
+		if arg < 0 {
+			err := fmt.Errorf("Negative operand: %d", arg)
+			return &InstructionError{Offset: offset, Op: ins.OpCode, Err: err}
 		}
 	}
 
+	return nil
+}
+
+// appendInstruction encodes an instruction, which has been checked already.
+func appendInstruction(buffer []byte, ins code.Instruction) []byte {
+	buffer = convertOp(buffer, ins)
+	for _, arg := range ins.Args {
+		buffer = binary.AppendUvarint(buffer, uint64(arg))
+	}
 	return buffer
 }
+
+// instructionSize returns the number of bytes appendInstruction produces.
+func instructionSize(ins code.Instruction) int {
+	size := 1
+	for _, arg := range ins.Args {
+		size += (bits.Len64(uint64(arg)|1) + 6) / 7
+	}
+	return size
+}
 func convertOp(buffer []byte, ins code.Instruction) []byte {
 	converted := int8(ins.OpCode)
 	buffer = append(buffer, byte(converted))
 	return buffer
 }
-func convertArg(buffer []byte, arg int) []byte {
-	buffer = binary.BigEndian.AppendUint16(buffer, uint16(arg))
-	return buffer
-}
@@ -7,6 +7,7 @@ import (
 
 	"github.com/alecthomas/assert/v2"
 	"github.com/pspiagicw/fenc/code"
+	"github.com/pspiagicw/fenc/emitter"
 	"github.com/pspiagicw/fenc/object"
 )
 
@@ -15,7 +16,8 @@ func TestSimple(t *testing.T) {
 		{OpCode: code.ADD_INT},
 	}
 
-	bytecode := ConvertBytecode(ins)
+	bytecode, err := ConvertBytecode(ins)
+	assert.NoError(t, err)
 
 	expected := []byte{2}
 
@@ -27,9 +29,10 @@ func TestPush(t *testing.T) {
 		{OpCode: code.PUSH, Args: []int{1}},
 		{OpCode: code.PUSH, Args: []int{65535}},
 	}
-	bytecode := ConvertBytecode(ins)
+	bytecode, err := ConvertBytecode(ins)
+	assert.NoError(t, err)
 
-	expected := []byte{1, 0, 1, 1, 255, 255}
+	expected := []byte{1, 1, 1, 255, 255, 3}
 
 	assert.Equal(t, bytecode, expected, "Converted bytecode not matching.")
 }
@@ -38,21 +41,51 @@ func TestClosure(t *testing.T) {
 	ins := []code.Instruction{
 		{OpCode: code.CLOSURE, Args: []int{65535, 65535}},
 	}
-	bytecode := ConvertBytecode(ins)
+	bytecode, err := ConvertBytecode(ins)
+	assert.NoError(t, err)
 
-	expected := []byte{33, 255, 255, 255, 255}
+	expected := []byte{33, 255, 255, 3, 255, 255, 3}
 
 	assert.Equal(t, bytecode, expected, "Converted bytecode not matching.")
 
 }
 
+func TestCollectionOperands(t *testing.T) {
+	ins := []code.Instruction{
+		{OpCode: code.ARRAY, Args: []int{3}},
+		{OpCode: code.HASH, Args: []int{2}},
+		{OpCode: code.BUILTIN, Args: []int{1}},
+	}
+	bytecode, err := ConvertBytecode(ins)
+	assert.NoError(t, err)
+
+	expected := []byte{34, 3, 35, 2, 43, 1}
+
+	assert.Equal(t, bytecode, expected, "Converted bytecode not matching.")
+}
+
+func TestStackOps(t *testing.T) {
+	ins := []code.Instruction{
+		{OpCode: code.POP},
+		{OpCode: code.DUP},
+		{OpCode: code.SWAP},
+	}
+	bytecode, err := ConvertBytecode(ins)
+	assert.NoError(t, err)
+
+	expected := []byte{47, 48, 49}
+
+	assert.Equal(t, bytecode, expected, "Converted bytecode not matching.")
+}
+
 func TestInt(t *testing.T) {
 	constants := []object.Object{
 		object.CreateInt(1),
 		object.CreateInt(2),
 	}
 
-	bytecode := ConvertConstants(constants)
+	bytecode, err := ConvertConstants(constants)
+	assert.NoError(t, err)
 	// TODO: Implement actual bytecode checking
 	expected := bytecode
 
@@ -64,8 +97,9 @@ func TestBool(t *testing.T) {
 		object.CreateBool(true),
 	}
 
-	bytecode := ConvertConstants(constants)
-	expected := []byte{0, 2, 4, 0, 4, 1}
+	bytecode, err := ConvertConstants(constants)
+	assert.NoError(t, err)
+	expected := []byte{2, 4, 0, 4, 1}
 
 	assert.Equal(t, bytecode, expected, "Converted bytecode not matching.")
 }
@@ -75,7 +109,8 @@ func TestFloat(t *testing.T) {
 		object.CreateFloat(67.2),
 	}
 
-	bytecode := ConvertConstants(constants)
+	bytecode, err := ConvertConstants(constants)
+	assert.NoError(t, err)
 	// TODO: Implement actual bytecode checking
 	expected := bytecode
 
@@ -87,7 +122,8 @@ func TestString(t *testing.T) {
 		object.CreateString("really short string!"),
 	}
 
-	bytecode := ConvertConstants(constants)
+	bytecode, err := ConvertConstants(constants)
+	assert.NoError(t, err)
 	// TODO: Implement actual bytecode checking
 	expected := bytecode
 
@@ -101,7 +137,8 @@ func TestFunction(t *testing.T) {
 			{OpCode: code.CLOSURE, Args: []int{2, 1}},
 		}),
 	}
-	bytecode := ConvertConstants(constants)
+	bytecode, err := ConvertConstants(constants)
+	assert.NoError(t, err)
 	// TODO: Implement actual bytecode checking
 	expected := bytecode
 
@@ -113,11 +150,12 @@ func TestEncoding(t *testing.T) {
 		{OpCode: code.PUSH, Args: []int{0}},
 	}
 	constants := []object.Object{}
-	bytecode := Convert(instructions, constants)
+	bytecode, err := Convert(emitter.ByteCode{Tape: instructions, Constants: constants})
+	assert.NoError(t, err)
 
 	reader := bytes.NewReader(bytecode)
 	buffer := make([]byte, 5)
-	_, err := io.ReadFull(reader, buffer)
+	_, err = io.ReadFull(reader, buffer)
 	assert.NoError(t, err, "Error while reading buffer")
 
 	assert.Equal(t, buffer, []byte("FENCY"), "Magic bytes not matching.")
@@ -126,5 +164,5 @@ func TestEncoding(t *testing.T) {
 	_, err = io.ReadFull(reader, buffer)
 	assert.NoError(t, err, "Error while reading buffer")
 
-	assert.Equal(t, buffer, []byte{1}, "Version number not matching")
+	assert.Equal(t, buffer, []byte{2}, "Version number not matching")
 }
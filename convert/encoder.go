@@ -0,0 +1,177 @@
+package convert
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+
+	"github.com/pspiagicw/fenc/code"
+	"github.com/pspiagicw/fenc/emitter"
+	"github.com/pspiagicw/fenc/object"
+)
+
+// Sections, which may follow the instruction stream.
+const (
+	debugSection byte = iota + 1
+	builtinSection
+)
+
+// chunkSize is the amount of encoded instructions collected, before handing them to the writer.
+const chunkSize = 4096
+
+// Encoder writes bytecode in the FENCY format to a stream.
+// Unlike Convert, it never holds the whole image in memory, every section is written as it is encoded.
+type Encoder struct {
+	w     *bufio.Writer
+	debug bool
+
+	// scratch is reused to encode a single constant, or a chunk of instructions.
+	scratch []byte
+}
+
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{
+		w: bufio.NewWriter(w),
+	}
+}
+
+// SetDebug controls whether the line tables of the program and of its functions are written, in a debug section.
+func (e *Encoder) SetDebug(debug bool) {
+	e.debug = debug
+}
+
+func (e *Encoder) Encode(bytecode emitter.ByteCode) error {
+	e.w.WriteString("FENCY")
+	e.w.WriteByte(byte(Version))
+
+	err := e.writeConstants(bytecode.Constants)
+	if err != nil {
+		return err
+	}
+
+	err = e.writeCode(bytecode.Tape)
+	if err != nil {
+		return err
+	}
+
+	if len(bytecode.Builtins) != 0 {
+		e.writeBuiltins(bytecode.Builtins)
+	}
+
+	if e.debug {
+		e.writeDebug(bytecode)
+	}
+
+	return e.w.Flush()
+}
+
+func (e *Encoder) writeUvarint(v uint64) {
+	e.scratch = binary.AppendUvarint(e.scratch[:0], v)
+	e.w.Write(e.scratch)
+}
+func (e *Encoder) writeVarint(v int64) {
+	e.scratch = binary.AppendVarint(e.scratch[:0], v)
+	e.w.Write(e.scratch)
+}
+func (e *Encoder) writeString(s string) {
+	e.writeUvarint(uint64(len(s)))
+	e.w.WriteString(s)
+}
+
+func (e *Encoder) writeConstants(constants []object.Object) error {
+	e.writeUvarint(uint64(len(constants)))
+
+	for i, constant := range constants {
+		var err error
+		if fn, ok := constant.(object.Function); ok {
+			err = e.writeFunction(fn)
+		} else {
+			e.scratch, err = convertConstant(e.scratch[:0], constant)
+			e.w.Write(e.scratch)
+		}
+		if err != nil {
+			return &ConstantError{Index: i, Constant: constant, Err: err}
+		}
+	}
+
+	return nil
+}
+func (e *Encoder) writeFunction(fn object.Function) error {
+	e.w.WriteByte(byte(Function))
+	e.writeString(fn.Name)
+	e.writeUvarint(uint64(fn.Arity))
+	e.writeUvarint(uint64(fn.Optional))
+	e.scratch = appendBool(e.scratch[:0], fn.Rest)
+	e.w.Write(e.scratch)
+	e.writeUvarint(uint64(len(fn.Params)))
+	for _, param := range fn.Params {
+		e.writeString(param)
+	}
+	e.writeUvarint(uint64(fn.NumLocals))
+
+	return e.writeCode(fn.Value)
+}
+
+// writeCode writes the length of the instruction stream, followed by the instructions.
+// The length is computed upfront, so that the instructions can be written without buffering the whole stream.
+func (e *Encoder) writeCode(tape []code.Instruction) error {
+	length := 0
+	for i, ins := range tape {
+		err := checkInstruction(i, ins)
+		if err != nil {
+			return err
+		}
+		length += instructionSize(ins)
+	}
+	e.writeUvarint(uint64(length))
+
+	buffer := e.scratch[:0]
+	for _, ins := range tape {
+		buffer = appendInstruction(buffer, ins)
+		if len(buffer) >= chunkSize {
+			e.w.Write(buffer)
+			buffer = buffer[:0]
+		}
+	}
+	e.w.Write(buffer)
+	e.scratch = buffer
+
+	return nil
+}
+
+// writeBuiltins writes the names of the builtins referenced by the program, in the order of their index.
+func (e *Encoder) writeBuiltins(names []string) {
+	e.w.WriteByte(builtinSection)
+	e.writeUvarint(uint64(len(names)))
+	for _, name := range names {
+		e.writeString(name)
+	}
+}
+
+// writeDebug writes the line table of the program, followed by the line table of every function constant that has one.
+func (e *Encoder) writeDebug(bytecode emitter.ByteCode) {
+	e.w.WriteByte(debugSection)
+	e.writeLines(bytecode.Lines)
+
+	functions := []int{}
+	for i, constant := range bytecode.Constants {
+		if fn, ok := constant.(object.Function); ok && len(fn.Lines) > 0 {
+			functions = append(functions, i)
+		}
+	}
+
+	e.writeUvarint(uint64(len(functions)))
+	for _, i := range functions {
+		e.writeUvarint(uint64(i))
+		e.writeLines(bytecode.Constants[i].(object.Function).Lines)
+	}
+}
+func (e *Encoder) writeLines(lines code.LineTable) {
+	e.writeUvarint(uint64(len(lines)))
+	for _, entry := range lines {
+		e.writeUvarint(uint64(entry.Offset))
+		e.writeString(entry.Position.File)
+		e.writeVarint(int64(entry.Position.Line))
+		e.writeVarint(int64(entry.Position.Col))
+	}
+}
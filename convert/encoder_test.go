@@ -0,0 +1,201 @@
+package convert
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/rand/v2"
+	"testing"
+
+	"github.com/alecthomas/assert/v2"
+	"github.com/pspiagicw/fenc/code"
+	"github.com/pspiagicw/fenc/emitter"
+	"github.com/pspiagicw/fenc/object"
+)
+
+func TestEncoderMatchesConvert(t *testing.T) {
+	r := rand.New(rand.NewPCG(3, 4))
+
+	for range 50 {
+		bytecode := emitter.ByteCode{
+			Tape:      randomTape(r),
+			Constants: randomConstants(r),
+			Builtins:  []string{"print", "len"}[:r.IntN(3)],
+		}
+
+		var buffer bytes.Buffer
+		err := NewEncoder(&buffer).Encode(bytecode)
+		assert.NoError(t, err)
+
+		data, err := Convert(bytecode)
+		assert.NoError(t, err)
+		assert.Equal(t, data, buffer.Bytes())
+	}
+}
+
+func TestEncoderDebug(t *testing.T) {
+	e := emitter.NewEmitter(map[string]object.Builtin{})
+	e.SetPosition("main.fen", 1, 1)
+	e.Function("add", []string{"x", "y"}, func(e *emitter.Emitter) error {
+		e.SetPosition("main.fen", 2, 5)
+		e.Load("x")
+		e.Load("y")
+		e.SetPosition("main.fen", 2, 7)
+		e.AddInt()
+		e.ReturnValue()
+		return nil
+	})
+	e.SetPosition("main.fen", 4, 1)
+	e.PushInt(1)
+	e.PushInt(2)
+	e.Load("add")
+	e.Call(2)
+	expected := e.Bytecode()
+
+	var buffer bytes.Buffer
+	encoder := NewEncoder(&buffer)
+	encoder.SetDebug(true)
+	err := encoder.Encode(expected)
+	assert.NoError(t, err)
+
+	bytecode, err := NewDecoder(&buffer).Decode()
+	assert.NoError(t, err)
+
+	assert.Equal(t, expected, bytecode)
+}
+
+func TestEncoderBuiltins(t *testing.T) {
+	e := emitter.NewEmitter(map[string]object.Builtin{
+		"print": {},
+		"len":   {},
+	})
+	e.PushString("hello")
+	e.Load("len")
+	e.Call(1)
+	e.Load("print")
+	e.Call(1)
+	expected := e.Bytecode()
+
+	var buffer bytes.Buffer
+	err := NewEncoder(&buffer).Encode(expected)
+	assert.NoError(t, err)
+
+	bytecode, err := Parse(buffer.Bytes())
+	assert.NoError(t, err)
+
+	assert.Equal(t, []string{"len", "print"}, bytecode.Builtins)
+	assert.Equal(t, expected, bytecode)
+}
+
+func TestEncoderError(t *testing.T) {
+	err := NewEncoder(io.Discard).Encode(emitter.ByteCode{
+		Constants: []object.Object{
+			object.CreateFunction([]code.Instruction{
+				{OpCode: code.JUMP, Args: []int{-1}},
+			}),
+		},
+	})
+
+	var constErr *ConstantError
+	assert.True(t, errors.As(err, &constErr))
+	assert.Equal(t, 0, constErr.Index)
+	assert.EqualError(t, err, "Unable to serialize constant 0: Unable to serialize instruction 0 (JUMP): Negative operand: -1")
+}
+
+func TestDecoderStream(t *testing.T) {
+	bytecode := emitter.ByteCode{
+		Tape: []code.Instruction{
+			{OpCode: code.PUSH, Args: []int{0}},
+		},
+		Constants: []object.Object{
+			object.CreateString("streamed"),
+		},
+	}
+
+	reader, writer := io.Pipe()
+	go func() {
+		writer.CloseWithError(NewEncoder(writer).Encode(bytecode))
+	}()
+
+	decoded, err := NewDecoder(reader).Decode()
+	assert.NoError(t, err)
+	assert.Equal(t, bytecode, decoded)
+}
+
+func benchmarkProgram() emitter.ByteCode {
+	r := rand.New(rand.NewPCG(5, 6))
+
+	bytecode := emitter.ByteCode{}
+	for range 1000 {
+		bytecode.Constants = append(bytecode.Constants, object.Function{
+			Name:  "fn",
+			Value: randomTape(r),
+		})
+		bytecode.Constants = append(bytecode.Constants, object.CreateString(randomString(r)))
+	}
+	for range 2000 {
+		bytecode.Tape = append(bytecode.Tape, randomTape(r)...)
+	}
+
+	return bytecode
+}
+
+func BenchmarkConvert(b *testing.B) {
+	bytecode := benchmarkProgram()
+	data, _ := Convert(bytecode)
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for range b.N {
+		_, err := Convert(bytecode)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkEncoder(b *testing.B) {
+	bytecode := benchmarkProgram()
+	data, _ := Convert(bytecode)
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for range b.N {
+		err := NewEncoder(io.Discard).Encode(bytecode)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkParse(b *testing.B) {
+	bytecode := benchmarkProgram()
+	data, _ := Convert(bytecode)
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for range b.N {
+		_, err := Parse(data)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDecoder(b *testing.B) {
+	bytecode := benchmarkProgram()
+	data, _ := Convert(bytecode)
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for range b.N {
+		_, err := NewDecoder(bytes.NewReader(data)).Decode()
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,542 @@
+package convert
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+
+	"github.com/pspiagicw/fenc/code"
+	"github.com/pspiagicw/fenc/emitter"
+	"github.com/pspiagicw/fenc/object"
+)
+
+var ErrMagic = errors.New("Invalid magic bytes, expected FENCY")
+
+// Parse decodes a FENCY binary, as produced by Convert or an Encoder.
+func Parse(data []byte) (emitter.ByteCode, error) {
+	return decode(bytes.NewReader(data))
+}
+
+// ParseReader decodes a FENCY binary from r, reading until the end of r.
+// Every version up to Version is accepted.
+func ParseReader(r io.Reader) (emitter.ByteCode, error) {
+	return NewDecoder(r).Decode()
+}
+
+// Decoder reads bytecode in the FENCY format from a buffered stream.
+type Decoder struct {
+	r *bufio.Reader
+}
+
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{
+		r: bufio.NewReader(r),
+	}
+}
+
+// Decode reads the header, the constants, the instructions and any optional section, until the end of the stream.
+func (d *Decoder) Decode() (emitter.ByteCode, error) {
+	return decode(d.r)
+}
+
+type byteReader interface {
+	io.Reader
+	io.ByteReader
+}
+
+func decode(r byteReader) (emitter.ByteCode, error) {
+	p := &parser{r: r}
+
+	magic, err := p.read(5)
+	if err != nil {
+		return emitter.ByteCode{}, err
+	}
+	if string(magic) != "FENCY" {
+		return emitter.ByteCode{}, ErrMagic
+	}
+
+	version, err := p.ReadByte()
+	if err != nil {
+		return emitter.ByteCode{}, err
+	}
+	if version < 1 || version > Version {
+		return emitter.ByteCode{}, fmt.Errorf("Unsupported version: %d", version)
+	}
+	p.version = int(version)
+
+	constants, err := p.parseConstants()
+	if err != nil {
+		return emitter.ByteCode{}, err
+	}
+
+	// The length of the instruction stream is 32 bits wide in version 1.
+	var length uint64
+	if p.version == 1 {
+		var v uint32
+		v, err = p.readUint32()
+		length = uint64(v)
+	} else {
+		length, err = p.readUvarint()
+	}
+	if err != nil {
+		return emitter.ByteCode{}, err
+	}
+
+	tape, err := p.parseBytecode(length)
+	if err != nil {
+		return emitter.ByteCode{}, err
+	}
+
+	bytecode := emitter.ByteCode{
+		Tape:      tape,
+		Constants: constants,
+	}
+
+	err = p.parseSections(&bytecode)
+	if err != nil {
+		return emitter.ByteCode{}, err
+	}
+
+	return bytecode, nil
+}
+
+// ParseBytecode decodes an instruction stream, as produced by ConvertBytecode.
+func ParseBytecode(data []byte) ([]code.Instruction, error) {
+	p := &parser{r: bytes.NewReader(data), version: Version}
+	return p.parseBytecode(uint64(len(data)))
+}
+
+type parser struct {
+	r       byteReader
+	version int
+}
+
+// maxPrealloc limits the buffer allocated upfront for a length read from the input, so corrupt input can't exhaust memory.
+const maxPrealloc = 1 << 20
+
+func (p *parser) read(n uint64) ([]byte, error) {
+	if n > maxPrealloc {
+		buffer, err := io.ReadAll(io.LimitReader(p.r, int64(min(n, math.MaxInt64))))
+		if err == nil && uint64(len(buffer)) != n {
+			err = io.ErrUnexpectedEOF
+		}
+		return buffer, err
+	}
+
+	buffer := make([]byte, n)
+	_, err := io.ReadFull(p.r, buffer)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return buffer, err
+}
+
+// ReadByte allows reading varints using encoding/binary.
+func (p *parser) ReadByte() (byte, error) {
+	b, err := p.r.ReadByte()
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return b, err
+}
+func (p *parser) readUint16() (uint16, error) {
+	b, err := p.read(2)
+	if err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint16(b), nil
+}
+func (p *parser) readUint32() (uint32, error) {
+	b, err := p.read(4)
+	if err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(b), nil
+}
+func (p *parser) readUvarint() (uint64, error) {
+	return binary.ReadUvarint(p)
+}
+
+// readString reads a string, prefixed by its length.
+func (p *parser) readString() (string, error) {
+	length, err := p.readLength()
+	if err != nil {
+		return "", err
+	}
+	b, err := p.read(length)
+	return string(b), err
+}
+
+// readLength reads a count or a length, which is fixed width in version 1.
+func (p *parser) readLength() (uint64, error) {
+	if p.version == 1 {
+		v, err := p.readUint16()
+		return uint64(v), err
+	}
+	return p.readUvarint()
+}
+
+func (p *parser) readInt() (int, error) {
+	if p.version == 1 {
+		v, err := p.readUint32()
+		return int(int32(v)), err
+	}
+
+	v, err := binary.ReadVarint(p)
+	if err != nil {
+		return 0, err
+	}
+	if int64(int(v)) != v {
+		return 0, fmt.Errorf("Integer out of range: %d", v)
+	}
+	return int(v), nil
+}
+
+func (p *parser) readOperand(width int) (int, error) {
+	if p.version == 1 {
+		switch width {
+		case 2:
+			v, err := p.readUint16()
+			return int(v), err
+		default:
+			return 0, fmt.Errorf("Unsupported operand width: %d", width)
+		}
+	}
+
+	v, err := p.readUvarint()
+	if err != nil {
+		return 0, err
+	}
+	if v > math.MaxInt {
+		return 0, fmt.Errorf("Operand out of range: %d", v)
+	}
+	return int(v), nil
+}
+
+func (p *parser) parseBytecode(length uint64) ([]code.Instruction, error) {
+	data, err := p.read(length)
+	if err != nil {
+		return nil, err
+	}
+
+	reader := bytes.NewReader(data)
+	inner := &parser{r: reader, version: p.version}
+
+	tape := []code.Instruction{}
+	for reader.Len() > 0 {
+		offset := len(data) - reader.Len()
+
+		op, _ := inner.ReadByte()
+		def, err := code.Lookup(code.Op(op))
+		if err != nil {
+			return nil, fmt.Errorf("Invalid instruction at offset %d: %w", offset, err)
+		}
+
+		ins := code.Instruction{OpCode: code.Op(op)}
+		for _, width := range def.OperandWidths {
+			arg, err := inner.readOperand(width)
+			if err != nil {
+				return nil, fmt.Errorf("Truncated operand for %s at offset %d: %w", ins.OpCode, offset, err)
+			}
+			ins.Args = append(ins.Args, arg)
+		}
+
+		tape = append(tape, ins)
+	}
+
+	return tape, nil
+}
+
+func (p *parser) parseConstants() ([]object.Object, error) {
+	count, err := p.readLength()
+	if err != nil {
+		return nil, err
+	}
+
+	constants := make([]object.Object, 0, min(count, maxPrealloc))
+	for range count {
+		constant, err := p.parseConstant()
+		if err != nil {
+			return nil, err
+		}
+		constants = append(constants, constant)
+	}
+
+	return constants, nil
+}
+func (p *parser) parseConstant() (object.Object, error) {
+	kind, err := p.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+
+	switch ConstKind(kind) {
+	case Int:
+		v, err := p.readInt()
+		if err != nil {
+			return nil, err
+		}
+		return object.CreateInt(v), nil
+	case Float:
+		v, err := p.readUint32()
+		if err != nil {
+			return nil, err
+		}
+		return object.CreateFloat(math.Float32frombits(v)), nil
+	case String:
+		length, err := p.readLength()
+		if err != nil {
+			return nil, err
+		}
+		b, err := p.read(length)
+		if err != nil {
+			return nil, err
+		}
+		return object.CreateString(string(b)), nil
+	case Bool:
+		b, err := p.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		return object.CreateBool(b != 0), nil
+	case Function:
+		return p.parseFunction()
+	case None:
+		if p.version == 1 {
+			break
+		}
+		return object.Null{}, nil
+	case Array:
+		if p.version == 1 {
+			break
+		}
+		count, err := p.readLength()
+		if err != nil {
+			return nil, err
+		}
+		values := make([]object.Object, 0, min(count, maxPrealloc))
+		for range count {
+			value, err := p.parseConstant()
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, value)
+		}
+		return object.CreateArray(values), nil
+	}
+
+	return nil, fmt.Errorf("Unknown constant kind: %d", kind)
+}
+func (p *parser) parseFunction() (object.Object, error) {
+	fn := object.Function{}
+
+	// Version 1 didn't store any metadata.
+	fn.UnknownArity = p.version == 1
+	if p.version != 1 {
+		err := p.parseMetadata(&fn)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	length, err := p.readLength()
+	if err != nil {
+		return nil, err
+	}
+	fn.Value, err = p.parseBytecode(length)
+	if err != nil {
+		return nil, err
+	}
+	if p.version == 1 {
+		fn.NumLocals = numLocals(fn)
+	}
+
+	return fn, nil
+}
+
+// parseMetadata reads the name, the parameters and the number of locals of a function.
+func (p *parser) parseMetadata(fn *object.Function) error {
+	name, err := p.readString()
+	if err != nil {
+		return err
+	}
+	arity, err := p.readUvarint()
+	if err != nil {
+		return err
+	}
+	optional, err := p.readUvarint()
+	if err != nil {
+		return err
+	}
+	rest, err := p.ReadByte()
+	if err != nil {
+		return err
+	}
+	count, err := p.readUvarint()
+	if err != nil {
+		return err
+	}
+	for range count {
+		param, err := p.readString()
+		if err != nil {
+			return err
+		}
+		fn.Params = append(fn.Params, param)
+	}
+	numLocals, err := p.readUvarint()
+	if err != nil {
+		return err
+	}
+
+	fn.Name = name
+	fn.Arity = int(arity)
+	fn.Optional = int(optional)
+	fn.Rest = rest != 0
+	fn.NumLocals = int(numLocals)
+	return nil
+}
+
+// numLocals derives the number of locals of a function written in version 1, from the highest slot it uses.
+func numLocals(fn object.Function) int {
+	count := fn.Arity
+	for _, ins := range fn.Value {
+		switch ins.OpCode {
+		case code.LOAD_LOCAL, code.STORE_LOCAL, code.CAPTURE_LOCAL, code.DEFINE_LOCAL:
+			count = max(count, ins.Args[0]+1)
+		}
+	}
+	return count
+}
+
+// parseSections reads the optional sections following the instruction stream, until the end of the input.
+func (p *parser) parseSections(bytecode *emitter.ByteCode) error {
+	for {
+		section, err := p.r.ReadByte()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case section == debugSection && p.version != 1:
+			err = p.parseDebug(bytecode)
+		case section == builtinSection && p.version != 1:
+			err = p.parseBuiltins(bytecode)
+		default:
+			err = fmt.Errorf("Unknown section: %d", section)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+func (p *parser) parseBuiltins(bytecode *emitter.ByteCode) error {
+	count, err := p.readUvarint()
+	if err != nil {
+		return err
+	}
+
+	names := make([]string, 0, min(count, maxPrealloc))
+	for range count {
+		length, err := p.readUvarint()
+		if err != nil {
+			return err
+		}
+		name, err := p.read(length)
+		if err != nil {
+			return err
+		}
+		names = append(names, string(name))
+	}
+	bytecode.Builtins = names
+
+	return nil
+}
+func (p *parser) parseDebug(bytecode *emitter.ByteCode) error {
+	lines, err := p.parseLines()
+	if err != nil {
+		return err
+	}
+	bytecode.Lines = lines
+	applyLines(bytecode.Tape, lines)
+
+	count, err := p.readUvarint()
+	if err != nil {
+		return err
+	}
+	for range count {
+		index, err := p.readUvarint()
+		if err != nil {
+			return err
+		}
+		lines, err := p.parseLines()
+		if err != nil {
+			return err
+		}
+
+		if index >= uint64(len(bytecode.Constants)) {
+			return fmt.Errorf("Line table for unknown constant: %d", index)
+		}
+		fn, ok := bytecode.Constants[index].(object.Function)
+		if !ok {
+			return fmt.Errorf("Line table for constant %d, which is not a function", index)
+		}
+		fn.Lines = lines
+		applyLines(fn.Value, lines)
+		bytecode.Constants[index] = fn
+	}
+
+	return nil
+}
+func (p *parser) parseLines() (code.LineTable, error) {
+	count, err := p.readUvarint()
+	if err != nil {
+		return nil, err
+	}
+
+	var lines code.LineTable
+	for range count {
+		offset, err := p.readUvarint()
+		if err != nil {
+			return nil, err
+		}
+		length, err := p.readUvarint()
+		if err != nil {
+			return nil, err
+		}
+		file, err := p.read(length)
+		if err != nil {
+			return nil, err
+		}
+		line, err := binary.ReadVarint(p)
+		if err != nil {
+			return nil, err
+		}
+		col, err := binary.ReadVarint(p)
+		if err != nil {
+			return nil, err
+		}
+
+		lines = append(lines, code.LineEntry{
+			Offset:   int(offset),
+			Position: code.Position{File: string(file), Line: int(line), Col: int(col)},
+		})
+	}
+
+	return lines, nil
+}
+
+// applyLines restores the instruction comments, the emitter sets them to the source position.
+func applyLines(tape []code.Instruction, lines code.LineTable) {
+	for i := range tape {
+		if pos, ok := lines.Lookup(i); ok {
+			tape[i].Comment = pos.String()
+		}
+	}
+}
@@ -0,0 +1,387 @@
+package convert
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"strings"
+	"testing"
+
+	"github.com/alecthomas/assert/v2"
+	"github.com/pspiagicw/fenc/code"
+	"github.com/pspiagicw/fenc/emitter"
+	"github.com/pspiagicw/fenc/object"
+	"github.com/pspiagicw/fenc/vm"
+)
+
+func TestParseSimple(t *testing.T) {
+	instructions := []code.Instruction{
+		{OpCode: code.PUSH, Args: []int{0}},
+		{OpCode: code.PUSH, Args: []int{1}},
+		{OpCode: code.ADD_INT},
+		{OpCode: code.STORE_GLOBAL, Args: []int{0}},
+	}
+	constants := []object.Object{
+		object.CreateInt(-5),
+		object.CreateString("hello"),
+		object.CreateBool(true),
+		object.CreateFloat(2.5),
+		object.CreateFunction([]code.Instruction{
+			{OpCode: code.LOAD_LOCAL, Args: []int{0}},
+			{OpCode: code.CLOSURE, Args: []int{2, 1}},
+			{OpCode: code.RETURN_VALUE},
+		}),
+	}
+
+	bytecode, err := Parse(mustConvert(t, instructions, constants))
+	assert.NoError(t, err)
+
+	assert.Equal(t, instructions, bytecode.Tape)
+	assert.Equal(t, constants, bytecode.Constants)
+}
+
+func TestParseReader(t *testing.T) {
+	instructions := []code.Instruction{
+		{OpCode: code.PUSH, Args: []int{0}},
+	}
+	constants := []object.Object{
+		object.CreateInt(1),
+	}
+
+	bytecode, err := ParseReader(bytes.NewReader(mustConvert(t, instructions, constants)))
+	assert.NoError(t, err)
+
+	assert.Equal(t, instructions, bytecode.Tape)
+	assert.Equal(t, constants, bytecode.Constants)
+}
+
+func TestParseInvalidHeader(t *testing.T) {
+	_, err := Parse([]byte("FANCY\x01"))
+	assert.IsError(t, err, ErrMagic)
+
+	_, err = Parse([]byte("FENCY\x09"))
+	assert.EqualError(t, err, "Unsupported version: 9")
+
+	_, err = Parse([]byte("FEN"))
+	assert.IsError(t, err, io.ErrUnexpectedEOF)
+}
+
+func TestParseTruncated(t *testing.T) {
+	data := mustConvert(t, []code.Instruction{
+		{OpCode: code.PUSH, Args: []int{0}},
+	}, []object.Object{
+		object.CreateString("hello"),
+	})
+
+	for i := range len(data) {
+		_, err := Parse(data[:i])
+		assert.Error(t, err, "Expected error for truncated input of length %d", i)
+	}
+
+	_, err := Parse(append(data, 0))
+	assert.EqualError(t, err, "Unknown section: 0")
+}
+
+func TestParseRoundTrip(t *testing.T) {
+	r := rand.New(rand.NewPCG(1, 2))
+
+	for i := range 200 {
+		instructions := randomTape(r)
+		constants := randomConstants(r)
+
+		bytecode, err := Parse(mustConvert(t, instructions, constants))
+		assert.NoError(t, err)
+
+		assert.Equal(t, instructions, bytecode.Tape, fmt.Sprintf("Tape differs in iteration %d", i))
+		assert.Equal(t, constants, bytecode.Constants, fmt.Sprintf("Constants differ in iteration %d", i))
+	}
+}
+
+func TestParseVersion1(t *testing.T) {
+	data := []byte("FENCY\x01")
+	data = append(data,
+		0, 4, // constants
+		byte(Int), 255, 255, 255, 254,
+		byte(Bool), 1,
+		byte(String), 0, 2, 'h', 'i',
+		byte(Function), 0, 4, byte(code.LOAD_LOCAL), 0, 0, byte(code.RETURN_VALUE),
+		0, 0, 0, 8, // instructions
+		byte(code.PUSH), 1, 0,
+		byte(code.CLOSURE), 0, 3, 0, 0,
+	)
+
+	bytecode, err := Parse(data)
+	assert.NoError(t, err)
+
+	assert.Equal(t, []object.Object{
+		object.CreateInt(-2),
+		object.CreateBool(true),
+		object.CreateString("hi"),
+		object.Function{
+			Value: []code.Instruction{
+				{OpCode: code.LOAD_LOCAL, Args: []int{0}},
+				{OpCode: code.RETURN_VALUE},
+			},
+			// Derived from the slots the function uses.
+			NumLocals:    1,
+			UnknownArity: true,
+		},
+	}, bytecode.Constants)
+	assert.Equal(t, []code.Instruction{
+		{OpCode: code.PUSH, Args: []int{256}},
+		{OpCode: code.CLOSURE, Args: []int{3, 0}},
+	}, bytecode.Tape)
+}
+
+func TestParseLargeValues(t *testing.T) {
+	instructions := []code.Instruction{
+		{OpCode: code.PUSH, Args: []int{1 << 20}},
+		{OpCode: code.JUMP, Args: []int{70000}},
+	}
+	constants := []object.Object{
+		object.CreateInt(1 << 40),
+		object.CreateInt(-(1 << 62)),
+		object.CreateString(strings.Repeat("x", 100000)),
+	}
+
+	bytecode, err := Parse(mustConvert(t, instructions, constants))
+	assert.NoError(t, err)
+
+	assert.Equal(t, instructions, bytecode.Tape)
+	assert.Equal(t, constants, bytecode.Constants)
+}
+
+func TestConvertNegativeOperand(t *testing.T) {
+	_, err := Convert(emitter.ByteCode{Tape: []code.Instruction{
+		{OpCode: code.JUMP, Args: []int{-1}},
+	}})
+
+	assert.EqualError(t, err, "Unable to serialize instruction 0 (JUMP): Negative operand: -1")
+}
+
+func TestParseMetadata(t *testing.T) {
+	instructions := []code.Instruction{}
+	constants := []object.Object{
+		object.Function{
+			Name:      "add",
+			Arity:     2,
+			Params:    []string{"x", "y"},
+			NumLocals: 3,
+			Value: []code.Instruction{
+				{OpCode: code.LOAD_LOCAL, Args: []int{0}},
+				{OpCode: code.LOAD_LOCAL, Args: []int{1}},
+				{OpCode: code.ADD_INT},
+				{OpCode: code.RETURN_VALUE},
+			},
+		},
+		object.Null{},
+		object.CreateArray([]object.Object{
+			object.CreateString("x"),
+			object.CreateArray([]object.Object{object.CreateInt(1)}),
+		}),
+	}
+
+	bytecode, err := Parse(mustConvert(t, instructions, constants))
+	assert.NoError(t, err)
+
+	assert.Equal(t, constants, bytecode.Constants)
+}
+
+func TestParseEmitted(t *testing.T) {
+	e := emitter.NewEmitter(map[string]object.Builtin{})
+	e.Function("fib", []string{"n"}, func(e *emitter.Emitter) error {
+		return e.If(
+			func(e *emitter.Emitter) error {
+				e.Load("n")
+				e.PushInt(2)
+				e.LtInt()
+				return nil
+			},
+			func(e *emitter.Emitter) error {
+				e.Load("n")
+				e.ReturnValue()
+				return nil
+			},
+			func(e *emitter.Emitter) error {
+				e.Load("n")
+				e.PushInt(1)
+				e.SubInt()
+				e.Load("fib")
+				e.Call(1)
+				e.ReturnValue()
+				return nil
+			},
+		)
+	})
+	e.Lambda([]string{}, func(e *emitter.Emitter) error {
+		e.PushString("hello")
+		e.PushFloat(1.5)
+		e.PushBool(true)
+		e.Array(3)
+		e.ReturnValue()
+		return nil
+	})
+	expected := e.Bytecode()
+
+	bytecode, err := Parse(mustConvert(t, expected.Tape, expected.Constants))
+	assert.NoError(t, err)
+
+	assert.Equal(t, expected, bytecode)
+}
+
+func TestConvertUnsupportedConstant(t *testing.T) {
+	_, err := Convert(emitter.ByteCode{Constants: []object.Object{
+		object.CreateInt(1),
+		object.Closure{},
+	}})
+
+	var constErr *ConstantError
+	assert.True(t, errors.As(err, &constErr))
+	assert.Equal(t, 1, constErr.Index)
+	assert.IsError(t, err, ErrUnsupportedConstant)
+	assert.EqualError(t, err, "Unable to serialize constant 1: Unsupported constant: object.Closure")
+}
+
+func TestConvertUnsupportedArrayElement(t *testing.T) {
+	_, err := Convert(emitter.ByteCode{Constants: []object.Object{
+		object.CreateArray([]object.Object{
+			object.CreateInt(1),
+			object.Hash{},
+		}),
+	}})
+
+	assert.EqualError(t, err, "Unable to serialize constant 0: Element 1: Unsupported constant: object.Hash")
+}
+
+func TestConvertInvalidInstruction(t *testing.T) {
+	_, err := Convert(emitter.ByteCode{Constants: []object.Object{
+		object.CreateInt(1),
+		object.CreateFunction([]code.Instruction{
+			{OpCode: code.PUSH, Args: []int{0}},
+			{OpCode: code.ARRAY},
+		}),
+	}})
+
+	var constErr *ConstantError
+	assert.True(t, errors.As(err, &constErr))
+	assert.Equal(t, 1, constErr.Index)
+
+	var insErr *InstructionError
+	assert.True(t, errors.As(err, &insErr))
+	assert.Equal(t, 1, insErr.Offset)
+	assert.Equal(t, code.ARRAY, insErr.Op)
+
+	_, err = Convert(emitter.ByteCode{Tape: []code.Instruction{
+		{OpCode: code.Op(255)},
+	}})
+	assert.EqualError(t, err, "Unable to serialize instruction 0 (Op(255)): Opcode 255 undefined")
+}
+
+func TestConvertBuiltins(t *testing.T) {
+	available := map[string]object.Builtin{
+		"double": {Internal: func(args ...object.Object) object.Object {
+			return object.CreateInt(args[0].(object.Int).Value * 2)
+		}},
+	}
+	e := emitter.NewEmitter(available)
+	e.PushInt(21)
+	e.Load("double")
+	e.Call(1)
+	expected := e.Bytecode()
+
+	data, err := Convert(expected)
+	assert.NoError(t, err)
+
+	bytecode, err := Parse(data)
+	assert.NoError(t, err)
+	assert.Equal(t, expected, bytecode)
+
+	machine, err := vm.NewVM(bytecode, available)
+	assert.NoError(t, err)
+	assert.NoError(t, machine.Run())
+	assert.Equal(t, object.Object(object.CreateInt(42)), machine.Peek())
+}
+
+func mustConvert(t *testing.T, instructions []code.Instruction, constants []object.Object) []byte {
+	data, err := Convert(emitter.ByteCode{Tape: instructions, Constants: constants})
+	assert.NoError(t, err)
+	return data
+}
+
+func randomConstants(r *rand.Rand) []object.Object {
+	constants := []object.Object{}
+
+	for range r.IntN(20) {
+		var o object.Object
+		switch r.IntN(7) {
+		case 0:
+			o = object.CreateInt(int(r.Int64()) - r.IntN(2)*int(r.Int64()))
+		case 1:
+			o = object.CreateFloat(r.Float32() * 1000)
+		case 2:
+			o = object.CreateString(randomString(r))
+		case 3:
+			o = object.CreateBool(r.IntN(2) == 1)
+		case 4:
+			o = object.Function{
+				Name:      randomString(r),
+				Arity:     r.IntN(10),
+				Optional:  r.IntN(3),
+				Rest:      r.IntN(2) == 1,
+				Params:    []string{randomString(r), randomString(r)},
+				NumLocals: r.IntN(10),
+				Value:     randomTape(r),
+			}
+		case 5:
+			o = object.Null{}
+		case 6:
+			o = object.CreateArray([]object.Object{
+				object.CreateString(randomString(r)),
+				object.CreateInt(r.IntN(100)),
+			})
+		}
+		constants = append(constants, o)
+	}
+
+	return constants
+}
+
+func randomString(r *rand.Rand) string {
+	b := make([]byte, r.IntN(300))
+	for i := range b {
+		b[i] = byte(r.IntN(256))
+	}
+	return string(b)
+}
+
+// numOps is the number of defined opcodes, which are numbered from 1.
+var numOps = func() int {
+	count := 0
+	for {
+		_, err := code.Lookup(code.Op(count + 1))
+		if err != nil {
+			return count
+		}
+		count++
+	}
+}()
+
+func randomTape(r *rand.Rand) []code.Instruction {
+	tape := []code.Instruction{}
+
+	for range r.IntN(50) {
+		op := code.Op(1 + r.IntN(numOps))
+
+		def, _ := code.Lookup(op)
+
+		ins := code.Instruction{OpCode: op}
+		for range def.OperandWidths {
+			ins.Args = append(ins.Args, r.IntN(1<<r.IntN(32)))
+		}
+		tape = append(tape, ins)
+	}
+
+	return tape
+}
@@ -35,6 +35,15 @@ func InstructionToString(bytecode []code.Instruction) string {
 		for _, arg := range instruction.Args {
 			args = append(args, strconv.Itoa(arg))
 		}
+
+		def, err := code.Lookup(instruction.OpCode)
+		if err != nil {
+			args = append(args, "(undefined)")
+		} else if len(def.OperandWidths) != len(instruction.Args) {
+			args = append(args, fmt.Sprintf("(expected %d operands)", len(def.OperandWidths)))
+		} else {
+			args = append(args, stackEffect(instruction))
+		}
 		argString := strings.Join(args, " ")
 		buffer.WriteString(fmt.Sprintf("%s %s %s\t%s\n", lineNumber, op, argString, instruction.Comment))
 		line++
@@ -42,6 +51,19 @@ func InstructionToString(bytecode []code.Instruction) string {
 	return strings.TrimSpace(buffer.String())
 }
 
+// stackEffect formats the values popped and pushed by a valid instruction, as in [-2 +1].
+func stackEffect(instruction code.Instruction) string {
+	pops, pushes, _ := code.StackEffect(instruction)
+
+	format := func(n int) string {
+		if n == code.Variable {
+			return "?"
+		}
+		return strconv.Itoa(n)
+	}
+	return lipgloss.NewStyle().Faint(true).Render(fmt.Sprintf("[-%s +%s]", format(pops), format(pushes)))
+}
+
 func getLineNumber(line int) string {
 	return lipgloss.NewStyle().Faint(true).Render(fmt.Sprintf("%05d", line))
 }
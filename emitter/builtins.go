@@ -0,0 +1,25 @@
+package emitter
+
+// BuiltinTable records the builtins referenced by the program, in the order of their first use.
+// The operand of BUILTIN is an index into this table, the VM binds the names when loading the program.
+type BuiltinTable struct {
+	names   []string
+	indexes map[string]int
+}
+
+func NewBuiltinTable() *BuiltinTable {
+	return &BuiltinTable{
+		names:   []string{},
+		indexes: map[string]int{},
+	}
+}
+
+func (b *BuiltinTable) Index(name string) int {
+	index, ok := b.indexes[name]
+	if !ok {
+		index = len(b.names)
+		b.names = append(b.names, name)
+		b.indexes[name] = index
+	}
+	return index
+}
@@ -2,8 +2,6 @@ package emitter
 
 import (
 	"fmt"
-
-	"maps"
 	"slices"
 
 	"github.com/pspiagicw/fenc/code"
@@ -14,9 +12,59 @@ import (
 
 type CompileFunc func(*Emitter) error
 
+type CondBranch struct {
+	Cond CompileFunc
+	Body CompileFunc
+}
+
+// Params describes the parameters of a function, in the order their arguments are passed.
+type Params struct {
+	Required []string
+	Optional []Optional
+	// Rest receives the extra arguments as an array, it is unused if empty.
+	Rest string
+}
+
+// names returns the names of the parameters, in the order of their slots.
+func (p Params) names() []string {
+	var names []string
+	names = append(names, p.Required...)
+	for _, arg := range p.Optional {
+		names = append(names, arg.Name)
+	}
+	if p.Rest != "" {
+		names = append(names, p.Rest)
+	}
+	return names
+}
+
+// Optional is a parameter with a default value.
+// The default is evaluated once, where the function is defined, a nil Default evaluates to null.
+type Optional struct {
+	Name    string
+	Default CompileFunc
+}
+
 type ByteCode struct {
 	Tape      []code.Instruction
 	Constants []object.Object
+	Lines     code.LineTable
+	// Builtins holds the names of the builtins referenced by the program.
+	Builtins []string
+}
+
+// loopContext tracks the pending jumps of an enclosing loop, they are patched once the loop is complete.
+type loopContext struct {
+	breaks    []int
+	continues []int
+
+	// tries is the number of enclosing try blocks when the loop started.
+	tries int
+}
+
+// tryContext tracks an enclosing try block, which has to be cleaned up when jumping out of it.
+type tryContext struct {
+	finally CompileFunc
 }
 
 type Emitter struct {
@@ -24,9 +72,21 @@ type Emitter struct {
 	tapeIndex int
 	constants *ConstantPool
 	symbols   *SymbolTable
+	loops     []*loopContext
+	tries     []*tryContext
+
+	temporaries int
+
+	// name of the function being emitted, empty at the top level.
+	name string
+
+	position code.Position
+	lines    code.LineTable
 
 	errors   []error
 	builtins map[string]object.Builtin
+
+	referenced *BuiltinTable
 }
 
 func (e *Emitter) registerError(msg string, values ...any) {
@@ -43,34 +103,83 @@ func (e *Emitter) enterScope() {
 func (e *Emitter) leaveScope() {
 	e.symbols = e.symbols.Outer
 }
+
+// Block emits the body within a new lexical scope.
+// Variables declared inside the block (using Declare) shadow outer variables, and are not visible after the block.
+func (e *Emitter) Block(body CompileFunc) error {
+	block := NewBlockSymbolTable(e.symbols)
+	e.symbols = block
+
+	err := body(e)
+	e.checkUndefined()
+
+	e.symbols = block.Outer
+	e.symbols.LeaveBlock(block)
+
+	return err
+}
+func (e *Emitter) enterLoop() *loopContext {
+	loop := &loopContext{tries: len(e.tries)}
+	e.loops = append(e.loops, loop)
+	return loop
+}
+func (e *Emitter) leaveLoop() {
+	e.loops = e.loops[:len(e.loops)-1]
+}
+func (e *Emitter) currentLoop() *loopContext {
+	if len(e.loops) == 0 {
+		return nil
+	}
+	return e.loops[len(e.loops)-1]
+}
 func (e *Emitter) NewSubEmitter() *Emitter {
 	n := NewEmitter(e.builtins)
 	n.constants = e.constants
+	n.referenced = e.referenced
 	n.symbols = e.symbols
+	n.position = e.position
 
 	return n
 }
 
 func NewEmitter(builtins map[string]object.Builtin) *Emitter {
 	e := &Emitter{
-		builtins:  builtins,
-		constants: NewConstantPool(),
-		tape:      []code.Instruction{},
-		tapeIndex: 0,
-		symbols:   NewSymbolTable(),
+		builtins:   builtins,
+		constants:  NewConstantPool(),
+		referenced: NewBuiltinTable(),
+		tape:       []code.Instruction{},
+		tapeIndex:  0,
+		symbols:    NewSymbolTable(),
 	}
 	e.setupBuiltins()
 	return e
 }
 func (e *Emitter) setupBuiltins() {
-	sortedKeys := slices.Sorted(maps.Keys(e.builtins))
-
-	for i, key := range sortedKeys {
-		e.symbols.DefineBuiltin(key, i)
+	for key := range e.builtins {
+		e.symbols.DefineBuiltin(key)
 	}
 }
 func (e *Emitter) Bytecode() ByteCode {
-	return ByteCode{e.tape, e.constants.constants}
+	e.checkUndefined()
+	return ByteCode{
+		Tape:      e.tape,
+		Constants: e.constants.constants,
+		Lines:     e.lines,
+		Builtins:  e.referenced.names,
+	}
+}
+
+// checkUndefined registers an error for every declared symbol of the current scope, which was never stored to.
+func (e *Emitter) checkUndefined() {
+	for _, s := range e.symbols.Undefined() {
+		e.registerError("Symbol declared but never defined: %s", s.Name)
+	}
+	e.symbols.pending = nil
+}
+
+// SetPosition tags every instruction emitted afterwards with the given source position.
+func (e *Emitter) SetPosition(file string, line, col int) {
+	e.position = code.Position{File: file, Line: line, Col: col}
 }
 
 func (e *Emitter) Emit(op code.Op, args ...int) int {
@@ -78,11 +187,25 @@ func (e *Emitter) Emit(op code.Op, args ...int) int {
 		OpCode: op,
 		Args:   args,
 	}
+	if e.position.IsValid() {
+		ins.Comment = e.position.String()
+		e.lines.Add(e.tapeIndex, e.position)
+	}
 	e.tape = append(e.tape, ins)
 	e.tapeIndex += 1
 	return e.tapeIndex - 1
 }
 
+func (e *Emitter) Pop() {
+	e.Emit(code.POP)
+}
+func (e *Emitter) Dup() {
+	e.Emit(code.DUP)
+}
+func (e *Emitter) Swap() {
+	e.Emit(code.SWAP)
+}
+
 func (e *Emitter) Constant(o object.Object) int {
 	return e.constants.Add(o)
 }
@@ -110,6 +233,10 @@ func (e *Emitter) PushString(value string) {
 	index := e.Constant(o)
 	e.Emit(code.PUSH, index)
 }
+func (e *Emitter) PushNull() {
+	index := e.Constant(object.Null{})
+	e.Emit(code.PUSH, index)
+}
 func (e *Emitter) PushFunction(value object.Function) {
 	index := e.Constant(value)
 	e.Emit(code.PUSH, index)
@@ -149,13 +276,433 @@ func (e *Emitter) If(cond, consequence, alternative CompileFunc) error {
 	return nil
 
 }
+
+// And emits a short-circuiting `and`, right is only evaluated if left is true.
+func (e *Emitter) And(left, right CompileFunc) error {
+	err := left(e)
+	if err != nil {
+		return err
+	}
+
+	shortPos := e.Emit(code.JUMP_FALSE, 0)
+
+	err = right(e)
+	if err != nil {
+		return err
+	}
+
+	endPos := e.Emit(code.JUMP, 0)
+
+	e.Patch(shortPos)
+	e.PushBool(false)
+
+	e.Patch(endPos)
+
+	return nil
+}
+
+// Or emits a short-circuiting `or`, right is only evaluated if left is false.
+func (e *Emitter) Or(left, right CompileFunc) error {
+	err := left(e)
+	if err != nil {
+		return err
+	}
+
+	shortPos := e.Emit(code.JUMP_TRUE, 0)
+
+	err = right(e)
+	if err != nil {
+		return err
+	}
+
+	endPos := e.Emit(code.JUMP, 0)
+
+	e.Patch(shortPos)
+	e.PushBool(true)
+
+	e.Patch(endPos)
+
+	return nil
+}
+
+// Cond emits a chain of branches, the body of the first branch whose condition holds is executed.
+// Every branch jumps directly to a single shared exit, instead of nesting an If per branch.
+func (e *Emitter) Cond(branches []CondBranch, otherwise CompileFunc) error {
+	exits := []int{}
+
+	for i, branch := range branches {
+		err := branch.Cond(e)
+		if err != nil {
+			return err
+		}
+
+		nextPos := e.Emit(code.JUMP_FALSE, 0)
+
+		err = branch.Body(e)
+		if err != nil {
+			return err
+		}
+
+		// The last branch falls through to the exit, unless there is an otherwise block to skip.
+		if i != len(branches)-1 || otherwise != nil {
+			exits = append(exits, e.Emit(code.JUMP, 0))
+		}
+
+		e.Patch(nextPos)
+	}
+
+	if otherwise != nil {
+		err := otherwise(e)
+		if err != nil {
+			return err
+		}
+	}
+
+	e.patchAll(exits)
+
+	return nil
+}
+
+func (e *Emitter) While(cond, body CompileFunc) error {
+	loopStart := e.tapeIndex
+
+	err := cond(e)
+	if err != nil {
+		return err
+	}
+
+	exitPos := e.Emit(code.JUMP_FALSE, 0)
+
+	breaks, err := e.loop(loopStart, body, nil)
+	if err != nil {
+		return err
+	}
+
+	e.Patch(exitPos)
+	e.patchAll(breaks)
+
+	return nil
+}
+
+// Loop emits an unconditional loop, which can only be left using Break (or by returning).
+func (e *Emitter) Loop(body CompileFunc) error {
+	loopStart := e.tapeIndex
+
+	breaks, err := e.loop(loopStart, body, nil)
+	if err != nil {
+		return err
+	}
+
+	e.patchAll(breaks)
+
+	return nil
+}
+
+// ForRange emits a numeric loop, similar to `for i = start, end, step` in Lua.
+// The end is inclusive, and a negative step counts downwards. If step is nil, it defaults to 1.
+func (e *Emitter) ForRange(varName string, start, end, step CompileFunc, body CompileFunc) error {
+	return e.Block(func(e *Emitter) error {
+		return e.forRange(varName, start, end, step, body)
+	})
+}
+
+// forRange emits the loop of ForRange, inside the block which holds the variable.
+// The loop counts in a hidden variable, the variable is bound afresh from it on every iteration like in Lua.
+// Thus closures created in the body keep their own value, and the body can't change the number of iterations.
+func (e *Emitter) forRange(varName string, start, end, step CompileFunc, body CompileFunc) error {
+	err := start(e)
+	if err != nil {
+		return err
+	}
+	counterSymbol := e.storeTemporary()
+
+	err = end(e)
+	if err != nil {
+		return err
+	}
+	endSymbol := e.storeTemporary()
+
+	if step != nil {
+		err = step(e)
+		if err != nil {
+			return err
+		}
+	} else {
+		e.PushInt(1)
+	}
+	stepSymbol := e.storeTemporary()
+	varSymbol := e.symbols.define(varName)
+
+	loopStart := e.tapeIndex
+
+	// Depending on the sign of the step, check if the counter crossed the end.
+	err = e.If(
+		func(e *Emitter) error {
+			e.loadSymbol(stepSymbol)
+			e.PushInt(0)
+			e.GtInt()
+			return nil
+		},
+		func(e *Emitter) error {
+			e.loadSymbol(counterSymbol)
+			e.loadSymbol(endSymbol)
+			e.LteInt()
+			return nil
+		},
+		func(e *Emitter) error {
+			e.loadSymbol(counterSymbol)
+			e.loadSymbol(endSymbol)
+			e.GteInt()
+			return nil
+		},
+	)
+	if err != nil {
+		return err
+	}
+
+	exitPos := e.Emit(code.JUMP_FALSE, 0)
+
+	e.loadSymbol(counterSymbol)
+	e.defineSymbol(varSymbol)
+
+	breaks, err := e.loop(loopStart, body, func(e *Emitter) error {
+		e.loadSymbol(counterSymbol)
+		e.loadSymbol(stepSymbol)
+		e.AddInt()
+		e.storeSymbol(counterSymbol)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	e.Patch(exitPos)
+	e.patchAll(breaks)
+
+	return nil
+}
+
+// ForEach emits a loop over the elements of an array, or over the keys of a hash.
+func (e *Emitter) ForEach(varName string, iterable CompileFunc, body CompileFunc) error {
+	return e.Block(func(e *Emitter) error {
+		return e.forEach(varName, iterable, body)
+	})
+}
+
+// forEach emits the loop of ForEach, inside the block which holds the variable.
+// The variable is bound afresh on every iteration, so closures created in the body keep their own element.
+func (e *Emitter) forEach(varName string, iterable CompileFunc, body CompileFunc) error {
+	err := iterable(e)
+	if err != nil {
+		return err
+	}
+	e.Emit(code.ITER)
+	iterSymbol := e.storeTemporary()
+
+	e.PushInt(0)
+	indexSymbol := e.storeTemporary()
+	varSymbol := e.symbols.define(varName)
+
+	loopStart := e.tapeIndex
+
+	e.loadSymbol(indexSymbol)
+	e.loadSymbol(iterSymbol)
+	e.Len()
+	e.LtInt()
+
+	exitPos := e.Emit(code.JUMP_FALSE, 0)
+
+	e.loadSymbol(iterSymbol)
+	e.loadSymbol(indexSymbol)
+	e.Index()
+	e.defineSymbol(varSymbol)
+
+	breaks, err := e.loop(loopStart, body, func(e *Emitter) error {
+		e.loadSymbol(indexSymbol)
+		e.PushInt(1)
+		e.AddInt()
+		e.storeSymbol(indexSymbol)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	e.Patch(exitPos)
+	e.patchAll(breaks)
+
+	return nil
+}
+
+// loop emits the body within a new loop context, followed by the step (if any) and a jump back to loopStart.
+// Continue lands on the step, the returned breaks still need to be patched to the exit by the caller.
+func (e *Emitter) loop(loopStart int, body, step CompileFunc) ([]int, error) {
+	loop := e.enterLoop()
+	err := body(e)
+	e.leaveLoop()
+	if err != nil {
+		return nil, err
+	}
+
+	e.patchAll(loop.continues)
+
+	if step != nil {
+		err = step(e)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	e.Emit(code.JUMP, loopStart)
+
+	return loop.breaks, nil
+}
+
+func (e *Emitter) Break() {
+	loop := e.currentLoop()
+	if loop == nil {
+		e.registerError("Can't use break outside of a loop.")
+		return
+	}
+
+	e.unwindTries(loop.tries)
+	loop.breaks = append(loop.breaks, e.Emit(code.JUMP, 0))
+}
+
+func (e *Emitter) Continue() {
+	loop := e.currentLoop()
+	if loop == nil {
+		e.registerError("Can't use continue outside of a loop.")
+		return
+	}
+
+	e.unwindTries(loop.tries)
+	loop.continues = append(loop.continues, e.Emit(code.JUMP, 0))
+}
+
+func (e *Emitter) Throw() {
+	e.Emit(code.THROW)
+}
+
+// Try emits a try block. If the body throws, the thrown value is stored in catchVar (if not empty) and the handler is executed.
+// The finally block (if any) is executed after the body or the handler, even if they throw, break, continue or return.
+// If handler is nil, the thrown value is thrown again after the finally block.
+func (e *Emitter) Try(body CompileFunc, catchVar string, handler CompileFunc, finally CompileFunc) error {
+	catchPos := e.Emit(code.SETUP_TRY, 0)
+
+	err := e.tryBody(body, finally)
+	if err != nil {
+		return err
+	}
+	e.Emit(code.POP_TRY)
+
+	err = e.runFinally(finally)
+	if err != nil {
+		return err
+	}
+	exits := []int{e.Emit(code.JUMP, 0)}
+
+	// The VM pushes the thrown value, and jumps here.
+	e.Patch(catchPos)
+
+	if handler != nil {
+		catch := func(e *Emitter) error {
+			return e.Block(func(e *Emitter) error {
+				if catchVar == "" {
+					e.Pop()
+				} else {
+					e.defineSymbol(e.symbols.define(catchVar))
+				}
+				return handler(e)
+			})
+		}
+
+		if finally == nil {
+			err = catch(e)
+			if err != nil {
+				return err
+			}
+		} else {
+			// The finally block still has to run, if the handler throws.
+			rethrowPos := e.Emit(code.SETUP_TRY, 0)
+
+			err = e.tryBody(catch, finally)
+			if err != nil {
+				return err
+			}
+			e.Emit(code.POP_TRY)
+
+			err = finally(e)
+			if err != nil {
+				return err
+			}
+			exits = append(exits, e.Emit(code.JUMP, 0))
+
+			e.Patch(rethrowPos)
+		}
+	}
+
+	if handler == nil || finally != nil {
+		// Run the finally block, and throw the value again.
+		thrown := e.storeTemporary()
+		err = e.runFinally(finally)
+		if err != nil {
+			return err
+		}
+		e.loadSymbol(thrown)
+		e.Throw()
+	}
+
+	e.patchAll(exits)
+
+	return nil
+}
+
+// tryBody emits the body while the try block is active, so jumps out of it clean up the try block.
+func (e *Emitter) tryBody(body CompileFunc, finally CompileFunc) error {
+	e.tries = append(e.tries, &tryContext{finally: finally})
+	err := body(e)
+	e.tries = e.tries[:len(e.tries)-1]
+	return err
+}
+
+func (e *Emitter) runFinally(finally CompileFunc) error {
+	if finally == nil {
+		return nil
+	}
+	return finally(e)
+}
+
+// unwindTries emits the cleanup of the try blocks entered after depth, innermost first.
+// This is used by jumps leaving the try blocks without going through their end.
+func (e *Emitter) unwindTries(depth int) {
+	tries := e.tries
+	for i := len(tries) - 1; i >= depth; i-- {
+		e.Emit(code.POP_TRY)
+
+		if tries[i].finally == nil {
+			continue
+		}
+
+		// The finally block runs outside its own try block.
+		e.tries = tries[:i]
+		err := tries[i].finally(e)
+		if err != nil {
+			e.errors = append(e.errors, err)
+		}
+	}
+	e.tries = tries
+}
 func (e *Emitter) Return() {
+	e.unwindTries(0)
 	e.Emit(code.RETURN)
 }
 
 func (e *Emitter) Patch(jumpPos int) {
 	ins := e.tape[jumpPos]
-	if ins.OpCode != code.JUMP && ins.OpCode != code.JUMP_FALSE {
+	switch ins.OpCode {
+	case code.JUMP, code.JUMP_FALSE, code.JUMP_TRUE, code.SETUP_TRY:
+	default:
 		e.registerError("Given instructions is not jump instruction.")
 	}
 
@@ -164,22 +711,74 @@ func (e *Emitter) Patch(jumpPos int) {
 	e.tape[jumpPos] = ins
 }
 
+func (e *Emitter) patchAll(jumps []int) {
+	for _, pos := range jumps {
+		e.Patch(pos)
+	}
+}
+
 func (e *Emitter) Store(name string) {
 	s := e.symbols.Define(name)
+	e.symbols.markStored(name)
+	e.storeSymbol(s)
+}
+
+// Declare creates new variables in the current scope, without storing anything in them.
+// Unlike Store, which assigns to an existing variable if one is visible, a declared variable shadows outer variables with the same name.
+// This also allows functions to refer to each other before they are defined, as in mutual recursion.
+// Every declared variable must eventually be stored to, otherwise an error is registered.
+// Declared local variables are bound afresh (to null) each time the declaration runs, as their slot may have been used by a variable of another block.
+func (e *Emitter) Declare(names ...string) {
+	for _, name := range names {
+		s := e.symbols.Declare(name)
+		if s.Scope == LOCAL_SCOPE {
+			e.Emit(code.DEFINE_LOCAL, s.Index)
+		}
+	}
+}
+
+func (e *Emitter) storeSymbol(s Symbol) {
 	switch s.Scope {
 	case GLOBAL_SCOPE:
 		e.Emit(code.STORE_GLOBAL, s.Index)
 	case LOCAL_SCOPE:
 		e.Emit(code.STORE_LOCAL, s.Index)
+	case FREE_SCOPE:
+		e.Emit(code.STORE_FREE, s.Index)
 	}
 }
 
+// defineSymbol stores the value on top of the stack in a new variable.
+// A local slot is bound afresh before the store, in case a closure captured the variable which used it before.
+func (e *Emitter) defineSymbol(s Symbol) {
+	if s.Scope == LOCAL_SCOPE {
+		e.Emit(code.DEFINE_LOCAL, s.Index)
+	}
+	e.storeSymbol(s)
+}
+
+// storeTemporary stores the value on top of the stack in a hidden variable, which can't clash with user variables.
+func (e *Emitter) storeTemporary() Symbol {
+	name := fmt.Sprintf("$tmp%d", e.temporaries)
+	e.temporaries += 1
+
+	s := e.symbols.define(name)
+	e.defineSymbol(s)
+	return s
+}
+
 func (e *Emitter) Load(name string) bool {
 	s, ok := e.symbols.Resolve(name)
 	if !ok {
 		e.registerError("Can't find symbol: %s", name)
 	}
 
+	e.loadSymbol(s)
+
+	return false
+}
+
+func (e *Emitter) loadSymbol(s Symbol) {
 	switch s.Scope {
 	case GLOBAL_SCOPE:
 		e.Emit(code.LOAD_GLOBAL, s.Index)
@@ -188,66 +787,101 @@ func (e *Emitter) Load(name string) bool {
 	case FREE_SCOPE:
 		e.Emit(code.LOAD_FREE, s.Index)
 	case BUILTIN_SCOPE:
-		e.Emit(code.BUILTIN, s.Index)
+		e.Emit(code.BUILTIN, e.referenced.Index(s.Name))
+	case FUNCTION_SCOPE:
+		e.Emit(code.CURRENT_CLOSURE)
 
 	}
+}
 
-	return false
+// captureSymbol pushes a cell holding the variable, so that the closure shares it with the enclosing scope.
+func (e *Emitter) captureSymbol(s Symbol) {
+	switch s.Scope {
+	case LOCAL_SCOPE:
+		e.Emit(code.CAPTURE_LOCAL, s.Index)
+	case FREE_SCOPE:
+		e.Emit(code.CAPTURE_FREE, s.Index)
+	default:
+		// The current closure can't be reassigned, the VM boxes the value itself.
+		e.loadSymbol(s)
+	}
 }
 
 func (e *Emitter) Function(name string, args []string, body CompileFunc) error {
+	return e.FunctionWithParams(name, Params{Required: args}, body)
+}
+func (e *Emitter) FunctionWithParams(name string, params Params, body CompileFunc) error {
 	funcEmitter := e.NewSubEmitter()
 	funcEmitter.enterScope()
+	funcEmitter.name = name
 
-	for _, arg := range args {
-		funcEmitter.symbols.Define(arg)
-	}
+	// The name is declared before the body is compiled, so that the function can call itself.
+	funcEmitter.symbols.DefineFunctionName(name)
 
-	err := body(funcEmitter)
+	err := e.closure(funcEmitter, params, body)
 	if err != nil {
 		return err
 	}
-
-	freeSymbols := funcEmitter.symbols.Free
-	funcEmitter.leaveScope()
-
-	for _, s := range freeSymbols {
-		e.Load(s.Name)
-	}
-
-	fn := object.Function{
-		Value: funcEmitter.tape,
-	}
-	// e.PushFunction(fn)
-	index := e.Constant(fn)
-	e.Emit(code.CLOSURE, index, len(freeSymbols))
 	e.Store(name)
 
 	return nil
 }
 
 func (e *Emitter) Lambda(args []string, body CompileFunc) error {
+	return e.LambdaWithParams(Params{Required: args}, body)
+}
+func (e *Emitter) LambdaWithParams(params Params, body CompileFunc) error {
 	funcEmitter := e.NewSubEmitter()
 	funcEmitter.enterScope()
+	funcEmitter.name = e.lambdaName()
 
-	for _, arg := range args {
-		funcEmitter.symbols.Define(arg)
+	return e.closure(funcEmitter, params, body)
+}
+
+// closure compiles the body using funcEmitter, and emits the closure along with the default values and the captured variables.
+func (e *Emitter) closure(funcEmitter *Emitter, params Params, body CompileFunc) error {
+	names := params.names()
+
+	// Arguments are always new variables, even if an outer scope has a variable with the same name.
+	for _, arg := range names {
+		funcEmitter.symbols.define(arg)
 	}
 
 	err := body(funcEmitter)
+	funcEmitter.checkUndefined()
+	e.errors = append(e.errors, funcEmitter.errors...)
 	if err != nil {
 		return err
 	}
 
 	freeSymbols := funcEmitter.symbols.Free
+	numLocals := funcEmitter.symbols.NumLocals()
 	funcEmitter.leaveScope()
 
+	for _, arg := range params.Optional {
+		if arg.Default == nil {
+			e.PushNull()
+			continue
+		}
+		err := arg.Default(e)
+		if err != nil {
+			return err
+		}
+	}
+
 	for _, s := range freeSymbols {
-		e.Load(s.Name)
+		e.captureSymbol(s)
 	}
 
 	fn := object.Function{
-		Value: funcEmitter.tape,
+		Value:     funcEmitter.tape,
+		Name:      funcEmitter.name,
+		Arity:     len(params.Required),
+		Optional:  len(params.Optional),
+		Rest:      params.Rest != "",
+		Params:    names,
+		NumLocals: numLocals,
+		Lines:     funcEmitter.lines,
 	}
 	// e.PushFunction(fn)
 	index := e.Constant(fn)
@@ -256,6 +890,14 @@ func (e *Emitter) Lambda(args []string, body CompileFunc) error {
 	return nil
 }
 
+// lambdaName returns a synthetic name for a lambda, qualified by the enclosing function.
+func (e *Emitter) lambdaName() string {
+	if e.name == "" {
+		return "<lambda>"
+	}
+	return e.name + ".<lambda>"
+}
+
 func (e *Emitter) Class(name string) {
 	e.PushString(name)
 
@@ -274,7 +916,19 @@ func (e *Emitter) Index() {
 func (e *Emitter) Access() {
 	e.Emit(code.ACCESS)
 }
+func (e *Emitter) Len() {
+	e.Emit(code.LEN)
+}
 func (e *Emitter) ReturnValue() {
+	e.unwindTries(0)
+
+	// A call returning its value right away is a tail call, which doesn't need a new frame.
+	// The return is kept, as jumps may target it, and builtins return to the calling frame.
+	last := len(e.tape) - 1
+	if last >= 0 && e.tape[last].OpCode == code.CALL && !e.symbols.isGlobal() {
+		e.tape[last].OpCode = code.TAIL_CALL
+	}
+
 	e.Emit(code.RETURN_VALUE)
 }
 
@@ -282,6 +936,21 @@ func (e *Emitter) Call(args int) {
 	e.Emit(code.CALL, args)
 }
 
+// CallKw calls a function with positional arguments, followed by keyword arguments.
+// The values of the keyword arguments are pushed in the order of names, before the function.
+func (e *Emitter) CallKw(positional int, names []string) {
+	values := make([]object.Object, 0, len(names))
+	for i, name := range names {
+		if slices.Contains(names[:i], name) {
+			e.registerError("Duplicate keyword argument: %s", name)
+		}
+		values = append(values, object.CreateString(name))
+	}
+
+	index := e.Constant(object.CreateArray(values))
+	e.Emit(code.CALL_KW, positional, index)
+}
+
 func (e *Emitter) AddInt() {
 	e.Emit(code.ADD_INT)
 }
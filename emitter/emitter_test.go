@@ -524,6 +524,66 @@ func TestOrBool(t *testing.T) {
 }
 
 // --- (string) ---
+func TestAndShortCircuit(t *testing.T) {
+	e := getEmitter()
+	e.And(
+		func(e *Emitter) error {
+			e.PushBool(true)
+			return nil
+		},
+		func(e *Emitter) error {
+			e.PushBool(false)
+			return nil
+		},
+	)
+
+	constants := []object.Object{
+		object.CreateBool(true),
+		object.CreateBool(false),
+		object.CreateBool(false),
+	}
+
+	expected := []code.Instruction{
+		createInstruction(code.PUSH, 0),       // 0000
+		createInstruction(code.JUMP_FALSE, 4), // 0001
+		createInstruction(code.PUSH, 1),       // 0002
+		createInstruction(code.JUMP, 5),       // 0003
+		createInstruction(code.PUSH, 2),       // 0004
+	}
+
+	testEmitter(t, e, expected, constants)
+}
+
+func TestOrShortCircuit(t *testing.T) {
+	e := getEmitter()
+	e.Or(
+		func(e *Emitter) error {
+			e.PushBool(false)
+			return nil
+		},
+		func(e *Emitter) error {
+			e.PushBool(true)
+			return nil
+		},
+	)
+
+	constants := []object.Object{
+		object.CreateBool(false),
+		object.CreateBool(true),
+		object.CreateBool(true),
+	}
+
+	expected := []code.Instruction{
+		createInstruction(code.PUSH, 0),      // 0000
+		createInstruction(code.JUMP_TRUE, 4), // 0001
+		createInstruction(code.PUSH, 1),      // 0002
+		createInstruction(code.JUMP, 5),      // 0003
+		createInstruction(code.PUSH, 2),      // 0004
+	}
+
+	testEmitter(t, e, expected, constants)
+}
+
 func TestAddString(t *testing.T) {
 	e := getEmitter()
 	e.PushString("foo")
@@ -627,6 +687,335 @@ func TestIfStatement(t *testing.T) {
 	testEmitter(t, e, expected, constants)
 
 }
+func TestCondStatement(t *testing.T) {
+	e := getEmitter()
+	e.Cond(
+		[]CondBranch{
+			{
+				Cond: func(e *Emitter) error {
+					e.PushBool(false)
+					return nil
+				},
+				Body: func(e *Emitter) error {
+					e.PushInt(1)
+					return nil
+				},
+			},
+			{
+				Cond: func(e *Emitter) error {
+					e.PushBool(true)
+					return nil
+				},
+				Body: func(e *Emitter) error {
+					e.PushInt(2)
+					return nil
+				},
+			},
+		},
+		func(e *Emitter) error {
+			e.PushInt(3)
+			return nil
+		},
+	)
+
+	constants := []object.Object{
+		object.CreateBool(false),
+		object.CreateInt(1),
+		object.CreateBool(true),
+		object.CreateInt(2),
+		object.CreateInt(3),
+	}
+
+	expected := []code.Instruction{
+		{OpCode: code.PUSH, Args: createArgs(0)},       // 0000
+		{OpCode: code.JUMP_FALSE, Args: createArgs(4)}, // 0001
+		{OpCode: code.PUSH, Args: createArgs(1)},       // 0002
+		{OpCode: code.JUMP, Args: createArgs(9)},       // 0003
+
+		{OpCode: code.PUSH, Args: createArgs(2)},       // 0004
+		{OpCode: code.JUMP_FALSE, Args: createArgs(8)}, // 0005
+		{OpCode: code.PUSH, Args: createArgs(3)},       // 0006
+		{OpCode: code.JUMP, Args: createArgs(9)},       // 0007
+
+		// -- Otherwise --
+		{OpCode: code.PUSH, Args: createArgs(4)}, // 0008
+	}
+
+	testEmitter(t, e, expected, constants)
+}
+
+func TestCondWithoutOtherwise(t *testing.T) {
+	e := getEmitter()
+	e.Cond(
+		[]CondBranch{
+			{
+				Cond: func(e *Emitter) error {
+					e.PushBool(true)
+					return nil
+				},
+				Body: func(e *Emitter) error {
+					e.PushInt(1)
+					return nil
+				},
+			},
+		},
+		nil,
+	)
+
+	constants := []object.Object{
+		object.CreateBool(true),
+		object.CreateInt(1),
+	}
+
+	expected := []code.Instruction{
+		{OpCode: code.PUSH, Args: createArgs(0)},       // 0000
+		{OpCode: code.JUMP_FALSE, Args: createArgs(3)}, // 0001
+		{OpCode: code.PUSH, Args: createArgs(1)},       // 0002
+	}
+
+	testEmitter(t, e, expected, constants)
+}
+
+func TestWhileStatement(t *testing.T) {
+	e := getEmitter()
+	e.PushInt(0)
+	e.Store("i")
+	e.While(
+		func(e *Emitter) error {
+			e.Load("i")
+			e.PushInt(10)
+			e.LtInt()
+			return nil
+		},
+		func(e *Emitter) error {
+			e.Load("i")
+			e.PushInt(1)
+			e.AddInt()
+			e.Store("i")
+			return nil
+		},
+	)
+
+	constants := []object.Object{
+		object.CreateInt(0),
+		object.CreateInt(10),
+		object.CreateInt(1),
+	}
+
+	expected := []code.Instruction{
+		{OpCode: code.PUSH, Args: createArgs(0)},         // 0000
+		{OpCode: code.STORE_GLOBAL, Args: createArgs(0)}, // 0001
+
+		// --- Condition ---
+		{OpCode: code.LOAD_GLOBAL, Args: createArgs(0)}, // 0002
+		{OpCode: code.PUSH, Args: createArgs(1)},        // 0003
+		{OpCode: code.LT_INT},                           // 0004
+		{OpCode: code.JUMP_FALSE, Args: createArgs(11)}, // 0005
+
+		// --- Body ---
+		{OpCode: code.LOAD_GLOBAL, Args: createArgs(0)},  // 0006
+		{OpCode: code.PUSH, Args: createArgs(2)},         // 0007
+		{OpCode: code.ADD_INT},                           // 0008
+		{OpCode: code.STORE_GLOBAL, Args: createArgs(0)}, // 0009
+		{OpCode: code.JUMP, Args: createArgs(2)},         // 0010
+	}
+
+	testEmitter(t, e, expected, constants)
+}
+func TestLoopBreakContinue(t *testing.T) {
+	e := getEmitter()
+	e.Loop(func(e *Emitter) error {
+		e.Continue()
+		e.Break()
+		return nil
+	})
+	e.PushInt(1)
+
+	constants := []object.Object{
+		object.CreateInt(1),
+	}
+
+	expected := []code.Instruction{
+		{OpCode: code.JUMP, Args: createArgs(2)}, // 0000 continue
+		{OpCode: code.JUMP, Args: createArgs(3)}, // 0001 break
+		{OpCode: code.JUMP, Args: createArgs(0)}, // 0002
+		{OpCode: code.PUSH, Args: createArgs(0)}, // 0003
+	}
+
+	testEmitter(t, e, expected, constants)
+}
+
+func TestWhileBreakContinue(t *testing.T) {
+	e := getEmitter()
+	e.While(
+		func(e *Emitter) error {
+			e.PushBool(true)
+			return nil
+		},
+		func(e *Emitter) error {
+			e.Break()
+			e.Continue()
+			return nil
+		},
+	)
+
+	constants := []object.Object{
+		object.CreateBool(true),
+	}
+
+	expected := []code.Instruction{
+		{OpCode: code.PUSH, Args: createArgs(0)},       // 0000
+		{OpCode: code.JUMP_FALSE, Args: createArgs(5)}, // 0001
+		{OpCode: code.JUMP, Args: createArgs(5)},       // 0002 break
+		{OpCode: code.JUMP, Args: createArgs(4)},       // 0003 continue
+		{OpCode: code.JUMP, Args: createArgs(0)},       // 0004
+	}
+
+	testEmitter(t, e, expected, constants)
+}
+
+func TestForEachStatement(t *testing.T) {
+	e := getEmitter()
+	e.ForEach("x",
+		func(e *Emitter) error {
+			e.PushInt(1)
+			e.Array(1)
+			return nil
+		},
+		func(e *Emitter) error {
+			e.Load("x")
+			e.Store("last")
+			return nil
+		},
+	)
+
+	constants := []object.Object{
+		object.CreateInt(1),
+		object.CreateInt(0),
+		object.CreateInt(1),
+	}
+
+	expected := []code.Instruction{
+		createInstruction(code.PUSH, 0),         // 0000
+		createInstruction(code.ARRAY, 1),        // 0001
+		createInstruction(code.ITER),            // 0002
+		createInstruction(code.STORE_GLOBAL, 0), // 0003 iterable
+		createInstruction(code.PUSH, 1),         // 0004
+		createInstruction(code.STORE_GLOBAL, 1), // 0005 index
+
+		// --- Condition ---
+		createInstruction(code.LOAD_GLOBAL, 1), // 0006
+		createInstruction(code.LOAD_GLOBAL, 0), // 0007
+		createInstruction(code.LEN),            // 0008
+		createInstruction(code.LT_INT),         // 0009
+		createInstruction(code.JUMP_FALSE, 22), // 0010
+
+		// --- Loop variable ---
+		createInstruction(code.LOAD_GLOBAL, 0),  // 0011
+		createInstruction(code.LOAD_GLOBAL, 1),  // 0012
+		createInstruction(code.INDEX),           // 0013
+		createInstruction(code.STORE_GLOBAL, 2), // 0014
+
+		// --- Body ---
+		createInstruction(code.LOAD_GLOBAL, 2),  // 0015
+		createInstruction(code.STORE_GLOBAL, 3), // 0016
+
+		// --- Step ---
+		createInstruction(code.LOAD_GLOBAL, 1),  // 0017
+		createInstruction(code.PUSH, 2),         // 0018
+		createInstruction(code.ADD_INT),         // 0019
+		createInstruction(code.STORE_GLOBAL, 1), // 0020
+		createInstruction(code.JUMP, 6),         // 0021
+	}
+
+	testEmitter(t, e, expected, constants)
+}
+
+func TestBreakOutsideLoop(t *testing.T) {
+	e := getEmitter()
+	e.Break()
+	e.Continue()
+
+	assert.Equal(t, 2, len(e.Errors()), "Expected break and continue to register errors.")
+}
+
+func TestBreakAcrossFunction(t *testing.T) {
+	e := getEmitter()
+	e.Loop(func(e *Emitter) error {
+		e.Lambda([]string{}, func(e *Emitter) error {
+			e.Break()
+			return nil
+		})
+		e.Break()
+		return nil
+	})
+
+	assert.Equal(t, 1, len(e.Errors()), "Expected break inside lambda to register an error.")
+}
+func TestTryCatch(t *testing.T) {
+	e := getEmitter()
+	e.Try(
+		func(e *Emitter) error {
+			e.PushInt(1)
+			e.Throw()
+			return nil
+		},
+		"err",
+		func(e *Emitter) error {
+			e.Load("err")
+			e.Store("result")
+			return nil
+		},
+		nil,
+	)
+
+	constants := []object.Object{
+		object.CreateInt(1),
+	}
+
+	expected := []code.Instruction{
+		createInstruction(code.SETUP_TRY, 5),    // 0000
+		createInstruction(code.PUSH, 0),         // 0001
+		createInstruction(code.THROW),           // 0002
+		createInstruction(code.POP_TRY),         // 0003
+		createInstruction(code.JUMP, 8),         // 0004
+		createInstruction(code.STORE_GLOBAL, 0), // 0005 catch
+		createInstruction(code.LOAD_GLOBAL, 0),  // 0006
+		createInstruction(code.STORE_GLOBAL, 1), // 0007
+	}
+
+	testEmitter(t, e, expected, constants)
+}
+
+func TestBreakInsideTry(t *testing.T) {
+	e := getEmitter()
+	e.Loop(func(e *Emitter) error {
+		return e.Try(
+			func(e *Emitter) error {
+				e.Break()
+				return nil
+			},
+			"",
+			func(e *Emitter) error {
+				return nil
+			},
+			nil,
+		)
+	})
+
+	expected := []code.Instruction{
+		createInstruction(code.SETUP_TRY, 5), // 0000
+		createInstruction(code.POP_TRY),      // 0001 break unwinds the try
+		createInstruction(code.JUMP, 7),      // 0002
+		createInstruction(code.POP_TRY),      // 0003
+		createInstruction(code.JUMP, 6),      // 0004
+		createInstruction(code.POP),          // 0005 catch
+		createInstruction(code.JUMP, 0),      // 0006
+	}
+
+	testEmitter(t, e, expected, []object.Object{})
+}
+
 func TestReturn(t *testing.T) {
 	e := getEmitter()
 	e.Return()
@@ -706,7 +1095,7 @@ func TestFunctionSimple(t *testing.T) {
 
 	constants := []object.Object{
 		object.CreateInt(2),
-		object.CreateFunction([]code.Instruction{
+		createFunction("test", nil, []code.Instruction{
 			{OpCode: code.PUSH, Args: createArgs(0)},
 		}),
 	}
@@ -734,14 +1123,14 @@ func TestFunctionWithArg(t *testing.T) {
 	})
 
 	constants := []object.Object{
-		object.CreateFunction([]code.Instruction{
+		withLocals(3, createFunction("add", []string{"x", "y"}, []code.Instruction{
 			{OpCode: code.LOAD_LOCAL, Args: createArgs(0)},
 			{OpCode: code.LOAD_LOCAL, Args: createArgs(1)},
 			{OpCode: code.ADD_INT},
 			{OpCode: code.STORE_LOCAL, Args: createArgs(2)},
 			{OpCode: code.LOAD_LOCAL, Args: createArgs(2)},
 			{OpCode: code.RETURN_VALUE},
-		}),
+		})),
 	}
 
 	expected := []code.Instruction{
@@ -751,6 +1140,282 @@ func TestFunctionWithArg(t *testing.T) {
 
 	testEmitter(t, e, expected, constants)
 }
+func TestFunctionWithParams(t *testing.T) {
+	e := getEmitter()
+	e.PushInt(80)
+	e.Store("port")
+	e.Lambda([]string{}, func(e *Emitter) error {
+		e.PushString("tcp")
+		e.Store("scheme")
+		e.FunctionWithParams("connect", Params{
+			Required: []string{"host"},
+			Optional: []Optional{
+				{Name: "port", Default: func(e *Emitter) error {
+					e.Load("port")
+					return nil
+				}},
+				{Name: "timeout"},
+			},
+			Rest: "options",
+		}, func(e *Emitter) error {
+			e.Load("scheme")
+			e.Load("options")
+			e.ReturnValue()
+			return nil
+		})
+		return nil
+	})
+
+	constants := []object.Object{
+		object.CreateInt(80),
+		object.CreateString("tcp"),
+		object.Null{},
+		object.Function{
+			Name:      "connect",
+			Arity:     1,
+			Optional:  2,
+			Rest:      true,
+			Params:    []string{"host", "port", "timeout", "options"},
+			NumLocals: 4,
+			Value: []code.Instruction{
+				createInstruction(code.LOAD_FREE, 0),
+				createInstruction(code.LOAD_LOCAL, 3),
+				createInstruction(code.RETURN_VALUE),
+			},
+		},
+		withLocals(2, createFunction("<lambda>", nil, []code.Instruction{
+			createInstruction(code.PUSH, 1),
+			createInstruction(code.STORE_LOCAL, 0),
+			// The defaults are evaluated in the enclosing function, before the captured variables.
+			createInstruction(code.LOAD_GLOBAL, 0),
+			createInstruction(code.PUSH, 2),
+			createInstruction(code.CAPTURE_LOCAL, 0),
+			createInstruction(code.CLOSURE, 3, 1),
+			createInstruction(code.STORE_LOCAL, 1),
+		})),
+	}
+
+	expected := []code.Instruction{
+		createInstruction(code.PUSH, 0),
+		createInstruction(code.STORE_GLOBAL, 0),
+		createInstruction(code.CLOSURE, 4, 0),
+	}
+
+	testEmitter(t, e, expected, constants)
+}
+func TestCallKw(t *testing.T) {
+	e := getEmitter()
+	e.PushInt(1)
+	e.PushString("red")
+	e.Load("print")
+	e.CallKw(1, []string{"color"})
+
+	constants := []object.Object{
+		object.CreateInt(1),
+		object.CreateString("red"),
+		object.CreateArray([]object.Object{
+			object.CreateString("color"),
+		}),
+	}
+
+	expected := []code.Instruction{
+		createInstruction(code.PUSH, 0),
+		createInstruction(code.PUSH, 1),
+		createInstruction(code.BUILTIN, 0),
+		createInstruction(code.CALL_KW, 1, 2),
+	}
+
+	testEmitter(t, e, expected, constants)
+}
+func TestCallKwDuplicate(t *testing.T) {
+	e := getEmitter()
+	e.PushInt(1)
+	e.PushInt(2)
+	e.Load("print")
+	e.CallKw(0, []string{"x", "x"})
+
+	errs := e.Errors()
+	assert.Equal(t, 1, len(errs), "Expected duplicate keyword argument to be reported.")
+	assert.Equal(t, "Duplicate keyword argument: x", errs[0].Error())
+}
+func TestFunctionRecursive(t *testing.T) {
+	e := getEmitter()
+	e.Function("loop", []string{}, func(e *Emitter) error {
+		e.Load("loop")
+		e.Call(0)
+		e.ReturnValue()
+		return nil
+	})
+
+	constants := []object.Object{
+		createFunction("loop", nil, []code.Instruction{
+			createInstruction(code.CURRENT_CLOSURE),
+			createInstruction(code.TAIL_CALL, 0),
+			createInstruction(code.RETURN_VALUE),
+		}),
+	}
+
+	expected := []code.Instruction{
+		createInstruction(code.CLOSURE, 0, 0),
+		createInstruction(code.STORE_GLOBAL, 0),
+	}
+
+	testEmitter(t, e, expected, constants)
+}
+
+func TestTailCallInTry(t *testing.T) {
+	e := getEmitter()
+	e.Function("f", []string{}, func(e *Emitter) error {
+		return e.Try(func(e *Emitter) error {
+			e.Load("f")
+			e.Call(0)
+			e.ReturnValue()
+			return nil
+		}, "err", func(e *Emitter) error {
+			return nil
+		}, nil)
+	})
+	e.Load("f")
+	e.Call(0)
+	e.ReturnValue()
+
+	fn := e.Bytecode().Constants[0].(object.Function)
+	assert.Equal(t, code.CALL, fn.Value[2].OpCode)
+	assert.Equal(t, code.POP_TRY, fn.Value[3].OpCode)
+
+	// The main program has no frame to reuse.
+	assert.Equal(t, code.CALL, e.Bytecode().Tape[3].OpCode)
+}
+
+func TestDeclare(t *testing.T) {
+	e := getEmitter()
+	e.Declare("isEven", "isOdd")
+	e.Load("isOdd")
+	e.PushInt(1)
+	e.Store("isOdd")
+	e.PushInt(2)
+	e.Store("isEven")
+
+	constants := []object.Object{
+		object.CreateInt(1),
+		object.CreateInt(2),
+	}
+
+	expected := []code.Instruction{
+		createInstruction(code.LOAD_GLOBAL, 1),
+		createInstruction(code.PUSH, 0),
+		createInstruction(code.STORE_GLOBAL, 1),
+		createInstruction(code.PUSH, 1),
+		createInstruction(code.STORE_GLOBAL, 0),
+	}
+
+	testEmitter(t, e, expected, constants)
+
+	e.Bytecode()
+	assert.Equal(t, 0, len(e.Errors()), "Expected no errors for defined symbols.")
+}
+
+func TestDeclareUndefined(t *testing.T) {
+	e := getEmitter()
+	e.Declare("defined", "undefined")
+	e.PushInt(1)
+	e.Store("defined")
+
+	e.Bytecode()
+
+	errs := e.Errors()
+	assert.Equal(t, 1, len(errs), "Expected undefined symbol to be reported.")
+	assert.Contains(t, errs[0].Error(), "undefined")
+}
+
+func TestDeclareUndefinedInFunction(t *testing.T) {
+	e := getEmitter()
+	e.Function("outer", []string{}, func(e *Emitter) error {
+		e.Declare("helper")
+		e.Load("helper")
+		e.Call(0)
+		e.ReturnValue()
+		return nil
+	})
+
+	e.Bytecode()
+
+	assert.Equal(t, 1, len(e.Errors()), "Expected undefined local symbol to be reported.")
+}
+
+func TestBlock(t *testing.T) {
+	e := getEmitter()
+	e.Function("f", []string{}, func(e *Emitter) error {
+		e.Block(func(e *Emitter) error {
+			e.PushInt(1)
+			e.Declare("x")
+			e.Store("x")
+			return nil
+		})
+		e.PushInt(2)
+		e.Declare("x")
+		e.Store("x")
+		return nil
+	})
+
+	constants := []object.Object{
+		object.CreateInt(1),
+		object.CreateInt(2),
+		withLocals(1, createFunction("f", nil, []code.Instruction{
+			createInstruction(code.PUSH, 0),
+			createInstruction(code.DEFINE_LOCAL, 0),
+			createInstruction(code.STORE_LOCAL, 0),
+			createInstruction(code.PUSH, 1),
+			createInstruction(code.DEFINE_LOCAL, 0),
+			createInstruction(code.STORE_LOCAL, 0),
+		})),
+	}
+
+	expected := []code.Instruction{
+		createInstruction(code.CLOSURE, 2, 0),
+		createInstruction(code.STORE_GLOBAL, 0),
+	}
+
+	testEmitter(t, e, expected, constants)
+}
+
+func TestNumLocals(t *testing.T) {
+	e := getEmitter()
+	e.Function("f", []string{"a"}, func(e *Emitter) error {
+		e.Block(func(e *Emitter) error {
+			e.PushInt(1)
+			e.Declare("x")
+			e.Store("x")
+			e.PushInt(2)
+			e.Declare("y")
+			e.Store("y")
+			return nil
+		})
+		// z reuses the slot of x.
+		e.Block(func(e *Emitter) error {
+			e.PushInt(3)
+			e.Declare("z")
+			e.Store("z")
+			return nil
+		})
+		return nil
+	})
+
+	fn := e.Bytecode().Constants[3].(object.Function)
+	assert.Equal(t, 1, fn.Arity)
+	assert.Equal(t, 3, fn.NumLocals)
+}
+
+func TestBlockUndefined(t *testing.T) {
+	e := getEmitter()
+	e.Block(func(e *Emitter) error {
+		e.Declare("x")
+		return nil
+	})
+
+	assert.Equal(t, 1, len(e.Errors()), "Expected undefined block variable to be reported.")
+}
+
 func TestLambda(t *testing.T) {
 	e := getEmitter()
 	e.Lambda([]string{}, func(e *Emitter) error {
@@ -760,7 +1425,7 @@ func TestLambda(t *testing.T) {
 
 	constants := []object.Object{
 		object.CreateInt(1),
-		object.CreateFunction([]code.Instruction{
+		createFunction("<lambda>", nil, []code.Instruction{
 			{OpCode: code.PUSH, Args: createArgs(0)},
 		}),
 	}
@@ -791,6 +1456,70 @@ func TestLambda(t *testing.T) {
 // 	dump.Dump(e.tape)
 // }
 
+func TestSetPosition(t *testing.T) {
+	e := getEmitter()
+	e.PushInt(1)
+	e.SetPosition("main.fen", 2, 5)
+	e.PushInt(2)
+	e.AddInt()
+	e.SetPosition("main.fen", 3, 1)
+	e.Store("x")
+
+	expected := []code.Instruction{
+		createInstruction(code.PUSH, 0),
+		{OpCode: code.PUSH, Args: []int{1}, Comment: "main.fen:2:5"},
+		{OpCode: code.ADD_INT, Comment: "main.fen:2:5"},
+		{OpCode: code.STORE_GLOBAL, Args: []int{0}, Comment: "main.fen:3:1"},
+	}
+	assert.Equal(t, expected, e.tape)
+
+	lines := e.Bytecode().Lines
+	assert.Equal(t, code.LineTable{
+		{Offset: 1, Position: code.Position{File: "main.fen", Line: 2, Col: 5}},
+		{Offset: 3, Position: code.Position{File: "main.fen", Line: 3, Col: 1}},
+	}, lines)
+
+	_, ok := lines.Lookup(0)
+	assert.False(t, ok)
+
+	pos, ok := lines.Lookup(2)
+	assert.True(t, ok)
+	assert.Equal(t, "main.fen:2:5", pos.String())
+}
+
+func TestSetPositionFunction(t *testing.T) {
+	e := getEmitter()
+	e.SetPosition("main.fen", 1, 1)
+	e.Function("f", []string{}, func(e *Emitter) error {
+		e.PushInt(1)
+		e.SetPosition("main.fen", 2, 3)
+		e.ReturnValue()
+		return nil
+	})
+
+	fn := e.constants.constants[1].(object.Function)
+	assert.Equal(t, code.LineTable{
+		{Offset: 0, Position: code.Position{File: "main.fen", Line: 1, Col: 1}},
+		{Offset: 1, Position: code.Position{File: "main.fen", Line: 2, Col: 3}},
+	}, fn.Lines)
+}
+
+func TestLambdaName(t *testing.T) {
+	e := getEmitter()
+	e.Function("outer", []string{}, func(e *Emitter) error {
+		e.Lambda([]string{"x", "y"}, func(e *Emitter) error {
+			e.Return()
+			return nil
+		})
+		e.ReturnValue()
+		return nil
+	})
+
+	fn := e.constants.constants[0].(object.Function)
+	assert.Equal(t, "outer.<lambda>", fn.Name)
+	assert.Equal(t, 2, fn.Arity)
+}
+
 func TestClosure(t *testing.T) {
 	e := getEmitter()
 	e.Lambda([]string{"a"}, func(e *Emitter) error {
@@ -806,14 +1535,14 @@ func TestClosure(t *testing.T) {
 	})
 
 	constants := []object.Object{
-		object.CreateFunction([]code.Instruction{
+		createFunction("<lambda>.<lambda>", []string{"b"}, []code.Instruction{
 			{OpCode: code.LOAD_FREE, Args: createArgs(0)},
 			{OpCode: code.LOAD_LOCAL, Args: createArgs(0)},
 			{OpCode: code.ADD_INT},
 			{OpCode: code.RETURN_VALUE},
 		}),
-		object.CreateFunction([]code.Instruction{
-			{OpCode: code.LOAD_LOCAL, Args: createArgs(0)},
+		createFunction("<lambda>", []string{"a"}, []code.Instruction{
+			{OpCode: code.CAPTURE_LOCAL, Args: createArgs(0)},
 			{OpCode: code.CLOSURE, Args: createArgs(0, 1)},
 			{OpCode: code.RETURN},
 		}),
@@ -826,6 +1555,40 @@ func TestClosure(t *testing.T) {
 	testEmitter(t, e, expected, constants)
 }
 
+func TestStoreFree(t *testing.T) {
+	e := getEmitter()
+	e.Lambda([]string{"a"}, func(e *Emitter) error {
+		e.Lambda([]string{}, func(e *Emitter) error {
+			e.PushInt(1)
+			e.Store("a")
+			e.Return()
+			return nil
+		})
+		e.Return()
+		return nil
+	})
+
+	constants := []object.Object{
+		object.CreateInt(1),
+		createFunction("<lambda>.<lambda>", nil, []code.Instruction{
+			createInstruction(code.PUSH, 0),
+			createInstruction(code.STORE_FREE, 0),
+			createInstruction(code.RETURN),
+		}),
+		createFunction("<lambda>", []string{"a"}, []code.Instruction{
+			createInstruction(code.CAPTURE_LOCAL, 0),
+			createInstruction(code.CLOSURE, 1, 1),
+			createInstruction(code.RETURN),
+		}),
+	}
+
+	expected := []code.Instruction{
+		createInstruction(code.CLOSURE, 2, 0),
+	}
+
+	testEmitter(t, e, expected, constants)
+}
+
 func TestNestedClosure(t *testing.T) {
 	e := getEmitter()
 	e.Lambda([]string{"a"}, func(e *Emitter) error {
@@ -847,7 +1610,7 @@ func TestNestedClosure(t *testing.T) {
 	})
 
 	constants := []object.Object{
-		object.CreateFunction([]code.Instruction{
+		createFunction("<lambda>.<lambda>.<lambda>", []string{"c"}, []code.Instruction{
 			createInstruction(code.LOAD_FREE, 0),
 			createInstruction(code.LOAD_FREE, 1),
 			createInstruction(code.ADD_INT),
@@ -855,14 +1618,14 @@ func TestNestedClosure(t *testing.T) {
 			createInstruction(code.ADD_INT),
 			createInstruction(code.RETURN_VALUE),
 		}),
-		object.CreateFunction([]code.Instruction{
-			createInstruction(code.LOAD_FREE, 0),
-			createInstruction(code.LOAD_LOCAL, 0),
+		createFunction("<lambda>.<lambda>", []string{"b"}, []code.Instruction{
+			createInstruction(code.CAPTURE_FREE, 0),
+			createInstruction(code.CAPTURE_LOCAL, 0),
 			createInstruction(code.CLOSURE, 0, 2),
 			createInstruction(code.RETURN_VALUE),
 		}),
-		object.CreateFunction([]code.Instruction{
-			createInstruction(code.LOAD_LOCAL, 0),
+		createFunction("<lambda>", []string{"a"}, []code.Instruction{
+			createInstruction(code.CAPTURE_LOCAL, 0),
 			createInstruction(code.CLOSURE, 1, 1),
 			createInstruction(code.RETURN_VALUE),
 		}),
@@ -910,7 +1673,7 @@ func TestClosureComplex(t *testing.T) {
 		object.CreateInt(66),
 		object.CreateInt(77),
 		object.CreateInt(88),
-		object.CreateFunction([]code.Instruction{
+		withLocals(1, createFunction("<lambda>.<lambda>.<lambda>", nil, []code.Instruction{
 			createInstruction(code.PUSH, 3),
 			createInstruction(code.STORE_LOCAL, 0),
 			createInstruction(code.LOAD_GLOBAL, 0),
@@ -921,22 +1684,22 @@ func TestClosureComplex(t *testing.T) {
 			createInstruction(code.LOAD_LOCAL, 0),
 			createInstruction(code.ADD_INT),
 			createInstruction(code.RETURN_VALUE),
-		}),
-		object.CreateFunction([]code.Instruction{
+		})),
+		withLocals(1, createFunction("<lambda>.<lambda>", nil, []code.Instruction{
 			createInstruction(code.PUSH, 2),
 			createInstruction(code.STORE_LOCAL, 0),
-			createInstruction(code.LOAD_FREE, 0),
-			createInstruction(code.LOAD_LOCAL, 0),
+			createInstruction(code.CAPTURE_FREE, 0),
+			createInstruction(code.CAPTURE_LOCAL, 0),
 			createInstruction(code.CLOSURE, 4, 2),
 			createInstruction(code.RETURN_VALUE),
-		}),
-		object.CreateFunction([]code.Instruction{
+		})),
+		withLocals(1, createFunction("<lambda>", nil, []code.Instruction{
 			createInstruction(code.PUSH, 1),
 			createInstruction(code.STORE_LOCAL, 0),
-			createInstruction(code.LOAD_LOCAL, 0),
+			createInstruction(code.CAPTURE_LOCAL, 0),
 			createInstruction(code.CLOSURE, 5, 1),
 			createInstruction(code.RETURN_VALUE),
-		}),
+		})),
 	}
 
 	expected := []code.Instruction{
@@ -1055,6 +1818,56 @@ func TestBuiltinPrint(t *testing.T) {
 	testEmitter(t, e, expected, constants)
 }
 
+func TestBuiltinTable(t *testing.T) {
+	e := NewEmitter(map[string]object.Builtin{
+		"print": {},
+		"len":   {},
+		"input": {},
+	})
+	e.Load("len")
+	e.Load("print")
+	e.Function("show", []string{"x"}, func(e *Emitter) error {
+		e.Load("x")
+		e.Load("print")
+		e.Call(1)
+		return nil
+	})
+	e.Load("len")
+
+	expected := []code.Instruction{
+		createInstruction(code.BUILTIN, 0),
+		createInstruction(code.BUILTIN, 1),
+		createInstruction(code.CLOSURE, 0, 0),
+		createInstruction(code.STORE_GLOBAL, 0),
+		createInstruction(code.BUILTIN, 0),
+	}
+
+	bytecode := e.Bytecode()
+	assert.Equal(t, expected, bytecode.Tape)
+	assert.Equal(t, []string{"len", "print"}, bytecode.Builtins)
+}
+
+func TestStackManipulation(t *testing.T) {
+	e := getEmitter()
+	e.PushInt(1)
+	e.Dup()
+	e.Swap()
+	e.Pop()
+
+	expected := []code.Instruction{
+		createInstruction(code.PUSH, 0),
+		createInstruction(code.DUP),
+		createInstruction(code.SWAP),
+		createInstruction(code.POP),
+	}
+
+	constants := []object.Object{
+		object.CreateInt(1),
+	}
+
+	testEmitter(t, e, expected, constants)
+}
+
 func TestClassEmpty(t *testing.T) {
 	e := getEmitter()
 	e.Class("Something")
@@ -1077,6 +1890,21 @@ func createArgs(args ...int) []int {
 func createInstruction(op code.Op, args ...int) code.Instruction {
 	return code.Instruction{OpCode: op, Args: args}
 }
+func createFunction(name string, params []string, tape []code.Instruction) object.Function {
+	return object.Function{
+		Name:   name,
+		Arity:  len(params),
+		Params: params,
+		// Most functions have no locals, other than their parameters.
+		NumLocals: len(params),
+		Value:     tape,
+	}
+}
+
+func withLocals(numLocals int, fn object.Function) object.Function {
+	fn.NumLocals = numLocals
+	return fn
+}
 
 func getEmitter() *Emitter {
 	e := NewEmitter(builtins)
@@ -1,5 +1,7 @@
 package emitter
 
+import "slices"
+
 // var BuiltinMap = map[int]object.Builtin{
 // 	PRINT: {
 // 		Internal: func(args []object.Object) object.Object {
@@ -26,6 +28,16 @@ type SymbolTable struct {
 	store      map[string]Symbol
 	storeIndex int
 	Free       []Symbol
+
+	// pending holds declared symbols, which haven't been stored to yet.
+	pending []Symbol
+
+	// block tables belong to the same function as their outer table, they only limit the visibility of symbols.
+	block bool
+	// captured is set once a closure refers to a symbol of this table, its slots can't be reused after that.
+	captured bool
+	// numLocals is the highest number of slots in use at once, by the function and all of its blocks.
+	numLocals int
 }
 
 func NewSymbolTable() *SymbolTable {
@@ -38,17 +50,46 @@ func NewSymbolTable() *SymbolTable {
 
 	return s
 }
-func (s *SymbolTable) DefineBuiltin(name string, bid int) {
-	b := Symbol{Name: name, Index: bid, Scope: BUILTIN_SCOPE}
+func (s *SymbolTable) DefineBuiltin(name string) {
+	b := Symbol{Name: name, Scope: BUILTIN_SCOPE}
 	s.store[name] = b
 }
 
+// DefineFunctionName defines the name of the function being compiled, so that its body can refer to itself.
+func (s *SymbolTable) DefineFunctionName(name string) Symbol {
+	f := Symbol{Name: name, Index: 0, Scope: FUNCTION_SCOPE}
+	s.store[name] = f
+	return f
+}
+
 func NewEnclosedSymbolTable(s *SymbolTable) *SymbolTable {
 	table := NewSymbolTable()
 	table.Outer = s
 	return table
 }
 
+// NewBlockSymbolTable creates a table for a lexical block, which allocates its slots after the ones of the outer table.
+func NewBlockSymbolTable(s *SymbolTable) *SymbolTable {
+	table := NewEnclosedSymbolTable(s)
+	table.block = true
+	table.storeIndex = s.storeIndex
+	return table
+}
+
+// LeaveBlock is called on the outer table, once the block is complete.
+// The slots of the block are reused by later symbols, unless a closure captured any of them.
+func (s *SymbolTable) LeaveBlock(block *SymbolTable) {
+	if block.captured {
+		s.storeIndex = block.storeIndex
+		s.captured = true
+	}
+}
+
+// isGlobal reports whether symbols defined in this table are globals.
+func (s *SymbolTable) isGlobal() bool {
+	return s.owner().Outer == nil
+}
+
 type Symbol struct {
 	Name  string
 	Index int
@@ -58,35 +99,104 @@ type Symbol struct {
 type SymbolScope string
 
 const (
-	GLOBAL_SCOPE  SymbolScope = "GLOBAL"
-	LOCAL_SCOPE   SymbolScope = "LOCAL"
-	FREE_SCOPE    SymbolScope = "FREE"
-	BUILTIN_SCOPE SymbolScope = "BUILTIN"
+	GLOBAL_SCOPE   SymbolScope = "GLOBAL"
+	LOCAL_SCOPE    SymbolScope = "LOCAL"
+	FREE_SCOPE     SymbolScope = "FREE"
+	BUILTIN_SCOPE  SymbolScope = "BUILTIN"
+	FUNCTION_SCOPE SymbolScope = "FUNCTION"
 )
 
 func (s *SymbolTable) Define(name string) Symbol {
-	if existing, ok := s.Resolve(name); ok {
+	// Assigning to the function's own name shadows it with a new variable.
+	if existing, ok := s.Resolve(name); ok && existing.Scope != FUNCTION_SCOPE {
 		// Use existing variable symbol
 		return existing
 	}
-	symbol := Symbol{Name: name, Index: s.storeIndex, Scope: GLOBAL_SCOPE}
-	if s.Outer != nil {
-		symbol.Scope = LOCAL_SCOPE
+
+	// Variables which aren't declared belong to the enclosing function, rather than to the innermost block.
+	owner := s.owner()
+	if owner == s {
+		return s.define(name)
+	}
+
+	// The slot is taken after the ones of the innermost block, and stays reserved once the blocks end.
+	index := s.storeIndex
+	for table := s; table != owner; table = table.Outer {
+		table.storeIndex = index + 1
+	}
+	owner.storeIndex = index
+	return owner.define(name)
+}
+
+// define always creates a new symbol in this table, without looking at the outer tables.
+func (s *SymbolTable) define(name string) Symbol {
+	symbol := Symbol{Name: name, Index: s.storeIndex, Scope: LOCAL_SCOPE}
+	if s.isGlobal() {
+		symbol.Scope = GLOBAL_SCOPE
 	}
 
 	s.store[name] = symbol
 	s.storeIndex++
+	s.owner().numLocals = max(s.owner().numLocals, s.storeIndex)
 	return symbol
 }
 
+// owner returns the table of the function, the blocks of this table belong to.
+func (s *SymbolTable) owner() *SymbolTable {
+	table := s
+	for table.block {
+		table = table.Outer
+	}
+	return table
+}
+
+// NumLocals returns the number of local slots a frame of the function needs.
+func (s *SymbolTable) NumLocals() int {
+	return s.owner().numLocals
+}
+
+// Declare reserves a new symbol in this table, before any value is stored in it.
+func (s *SymbolTable) Declare(name string) Symbol {
+	symbol := s.define(name)
+	s.pending = append(s.pending, symbol)
+	return symbol
+}
+
+// markStored removes a pending declaration of name, from the table which owns the variable.
+func (s *SymbolTable) markStored(name string) {
+	for table := s; table != nil; table = table.Outer {
+		symbol, ok := table.store[name]
+		if !ok || symbol.Scope == FREE_SCOPE {
+			continue
+		}
+
+		table.pending = slices.DeleteFunc(table.pending, func(p Symbol) bool {
+			return p.Name == name
+		})
+		return
+	}
+}
+
+// Undefined returns the declared symbols, which were never stored to.
+func (s *SymbolTable) Undefined() []Symbol {
+	return s.pending
+}
+
 func (s *SymbolTable) Resolve(name string) (Symbol, bool) {
 	obj, ok := s.store[name]
 	if !ok && s.Outer != nil {
 		obj, ok = s.Outer.Resolve(name)
-		if !ok {
+		if !ok || s.block {
+			return obj, ok
+		}
+
+		if obj.Scope == BUILTIN_SCOPE {
 			return obj, ok
 		}
 
+		// The symbol is used by a nested function, thus it outlives any block declaring it.
+		s.Outer.markCaptured(obj)
+
 		if obj.Scope == GLOBAL_SCOPE {
 			return obj, ok
 		}
@@ -96,6 +206,20 @@ func (s *SymbolTable) Resolve(name string) (Symbol, bool) {
 	}
 	return obj, ok
 }
+
+// markCaptured flags the table owning the symbol, looking through the blocks of the current function.
+func (s *SymbolTable) markCaptured(symbol Symbol) {
+	for table := s; table != nil; table = table.Outer {
+		if existing, ok := table.store[symbol.Name]; ok && existing == symbol {
+			table.captured = true
+			return
+		}
+
+		if !table.block {
+			return
+		}
+	}
+}
 func (s *SymbolTable) defineFree(original Symbol) Symbol {
 	s.Free = append(s.Free, original)
 
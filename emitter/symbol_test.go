@@ -63,3 +63,107 @@ func TestFree(t *testing.T) {
 		assert.Equal(t, tt.expectedFreeSymbols, tt.table.Free)
 	}
 }
+
+func TestDefineFunctionName(t *testing.T) {
+	global := NewSymbolTable()
+	local := NewEnclosedSymbolTable(global)
+	local.DefineFunctionName("fn")
+
+	nested := NewEnclosedSymbolTable(local)
+
+	result, ok := local.Resolve("fn")
+	assert.True(t, ok, "Function name not resolvable")
+	assert.Equal(t, Symbol{Name: "fn", Scope: FUNCTION_SCOPE, Index: 0}, result)
+
+	result, ok = nested.Resolve("fn")
+	assert.True(t, ok, "Function name not resolvable")
+	assert.Equal(t, Symbol{Name: "fn", Scope: FREE_SCOPE, Index: 0}, result)
+
+	// Assigning to the function name shadows it.
+	result = local.Define("fn")
+	assert.Equal(t, Symbol{Name: "fn", Scope: LOCAL_SCOPE, Index: 0}, result)
+}
+
+func TestBlockShadowing(t *testing.T) {
+	global := NewSymbolTable()
+	global.Define("x")
+
+	local := NewEnclosedSymbolTable(global)
+	local.Define("a")
+
+	block := NewBlockSymbolTable(local)
+	block.Declare("x")
+
+	result, ok := block.Resolve("x")
+	assert.True(t, ok, "Shadowed symbol not resolvable")
+	assert.Equal(t, Symbol{Name: "x", Scope: LOCAL_SCOPE, Index: 1}, result)
+
+	result, ok = block.Resolve("a")
+	assert.True(t, ok, "Outer local not resolvable from block")
+	assert.Equal(t, Symbol{Name: "a", Scope: LOCAL_SCOPE, Index: 0}, result)
+
+	local.LeaveBlock(block)
+
+	result, ok = local.Resolve("x")
+	assert.True(t, ok, "Global not resolvable after block")
+	assert.Equal(t, Symbol{Name: "x", Scope: GLOBAL_SCOPE, Index: 0}, result)
+
+	// The slot of the block variable is reused.
+	result = local.Define("b")
+	assert.Equal(t, Symbol{Name: "b", Scope: LOCAL_SCOPE, Index: 1}, result)
+}
+
+func TestBlockGlobal(t *testing.T) {
+	global := NewSymbolTable()
+	global.Define("x")
+
+	block := NewBlockSymbolTable(global)
+	result := block.Declare("y")
+	assert.Equal(t, Symbol{Name: "y", Scope: GLOBAL_SCOPE, Index: 1}, result)
+
+	global.LeaveBlock(block)
+
+	_, ok := global.Resolve("y")
+	assert.False(t, ok, "Block variable visible after block")
+}
+
+func TestBlockCaptured(t *testing.T) {
+	global := NewSymbolTable()
+	local := NewEnclosedSymbolTable(global)
+
+	block := NewBlockSymbolTable(local)
+	block.Declare("x")
+
+	closure := NewEnclosedSymbolTable(block)
+	result, ok := closure.Resolve("x")
+	assert.True(t, ok, "Block variable not resolvable from closure")
+	assert.Equal(t, Symbol{Name: "x", Scope: FREE_SCOPE, Index: 0}, result)
+
+	local.LeaveBlock(block)
+
+	// The captured slot is not reused.
+	result = local.Define("y")
+	assert.Equal(t, Symbol{Name: "y", Scope: LOCAL_SCOPE, Index: 1}, result)
+}
+
+func TestBlockImplicitDefine(t *testing.T) {
+	global := NewSymbolTable()
+	local := NewEnclosedSymbolTable(global)
+	local.Define("a")
+
+	block := NewBlockSymbolTable(local)
+	block.Declare("x")
+
+	// Variables which aren't declared belong to the function.
+	result := block.Define("y")
+	assert.Equal(t, Symbol{Name: "y", Scope: LOCAL_SCOPE, Index: 2}, result)
+
+	local.LeaveBlock(block)
+
+	result, ok := local.Resolve("y")
+	assert.True(t, ok, "Implicitly defined variable not visible after block")
+	assert.Equal(t, Symbol{Name: "y", Scope: LOCAL_SCOPE, Index: 2}, result)
+
+	result = local.Define("z")
+	assert.Equal(t, Symbol{Name: "z", Scope: LOCAL_SCOPE, Index: 3}, result)
+}
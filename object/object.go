@@ -23,6 +23,8 @@ const (
 	CLASS    CType = "CLASS"
 	INSTANCE CType = "INSTANCE"
 	NULL     CType = "NULL"
+	CELL     CType = "CELL"
+	ERROR    CType = "ERROR"
 )
 
 type Object interface {
@@ -134,11 +136,36 @@ func (f String) Content() string {
 type Function struct {
 	// TODO: Change the string and content function
 	Value []code.Instruction
+	// Name is used in tracebacks, lambdas get a synthetic name.
+	Name string
+	// Arity is the number of required parameters, they are followed by the optional ones, and by the rest parameter.
+	Arity    int
+	Optional int
+	Rest     bool
+	// UnknownArity is set for functions decoded from version 1 files, which didn't record their parameters.
+	// Calls to them aren't checked.
+	UnknownArity bool
+	// Params holds the names of the parameters, used to bind keyword arguments.
+	Params []string
+	// NumLocals is the number of local slots, including the parameters.
+	NumLocals int
+	Lines     code.LineTable
 }
 
 func (f Function) Type() CType {
 	return FUNCTION
 }
+
+// Arguments returns the range of the number of arguments the function accepts.
+func (f Function) Arguments() Arity {
+	if f.UnknownArity {
+		return Arity{Min: 0, Max: Variadic}
+	}
+	if f.Rest {
+		return Arity{Min: f.Arity, Max: Variadic}
+	}
+	return Arity{Min: f.Arity, Max: f.Arity + f.Optional}
+}
 func (f Function) String() string {
 	return "instructions"
 }
@@ -149,7 +176,9 @@ func (f Function) Content() string {
 type Closure struct {
 	// TODO: Change the string and content function
 	Value Function
-	Free  []Object
+	Free  []*Cell
+	// Defaults holds the values of the optional parameters.
+	Defaults []Object
 }
 
 func (c Closure) Type() CType {
@@ -162,6 +191,22 @@ func (c Closure) Content() string {
 	return "closure"
 }
 
+// Cell boxes a variable captured by a closure.
+// The enclosing function and all closures capturing the variable share the same cell, thus see each other's updates.
+type Cell struct {
+	Value Object
+}
+
+func (c *Cell) Type() CType {
+	return CELL
+}
+func (c *Cell) String() string {
+	return "cell"
+}
+func (c *Cell) Content() string {
+	return "cell"
+}
+
 type Array struct {
 	Values []Object
 }
@@ -233,6 +278,10 @@ func (i Instance) Content() string {
 
 type Builtin struct {
 	Internal func(...Object) Object
+	// Arity is optional, the VM checks the number of arguments against it before calling Internal.
+	Arity *Arity
+	// Name is set by the VM, when binding the builtin.
+	Name string
 }
 
 func (b Builtin) Type() CType {
@@ -245,6 +294,44 @@ func (b Builtin) Content() string {
 	return "builtin"
 }
 
+// Variadic is the maximum of an Arity without an upper bound.
+const Variadic = -1
+
+// Arity is the range of the number of arguments a callable accepts.
+type Arity struct {
+	Min int
+	Max int
+}
+
+func (a Arity) Accepts(n int) bool {
+	return n >= a.Min && (a.Max == Variadic || n <= a.Max)
+}
+func (a Arity) String() string {
+	switch a.Max {
+	case a.Min:
+		return fmt.Sprintf("%d", a.Min)
+	case Variadic:
+		return fmt.Sprintf("at least %d", a.Min)
+	default:
+		return fmt.Sprintf("%d to %d", a.Min, a.Max)
+	}
+}
+
+// Error is thrown by the VM on runtime faults, such as division by zero.
+type Error struct {
+	Message string
+}
+
+func (e Error) Type() CType {
+	return ERROR
+}
+func (e Error) String() string {
+	return e.Message
+}
+func (e Error) Content() string {
+	return e.Message
+}
+
 type Null struct {
 }
 
@@ -0,0 +1,118 @@
+package vm
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+
+	"github.com/pspiagicw/fenc/code"
+	"github.com/pspiagicw/fenc/object"
+)
+
+// RuntimeError is returned by Run, when the program fails and the failure is not caught.
+type RuntimeError struct {
+	Message string
+	// Op and IP point to the instruction that failed, in the innermost frame.
+	Op code.Op
+	IP int
+	// Position is the source position of the failing instruction, if the emitter recorded one.
+	Position code.Position
+	// Depth is the number of frames on the call stack.
+	Depth int
+	// Trace is a snapshot of the call stack, innermost frame first.
+	Trace []TraceEntry
+	// Value holds the thrown value, for uncaught exceptions.
+	Value object.Object
+}
+
+// TraceEntry describes a single frame, at the time of the error.
+type TraceEntry struct {
+	Name     string
+	Op       code.Op
+	IP       int
+	Position code.Position
+}
+
+func (e *RuntimeError) Error() string {
+	if e.Position.IsValid() {
+		return fmt.Sprintf("%s: %s (%s at %d, depth %d)", e.Position, e.Message, e.Op, e.IP, e.Depth)
+	}
+	return fmt.Sprintf("%s (%s at %d, depth %d)", e.Message, e.Op, e.IP, e.Depth)
+}
+
+// Traceback formats the error along with the call stack, similar to Python.
+func (e *RuntimeError) Traceback() string {
+	var b strings.Builder
+
+	b.WriteString("Traceback (most recent call first):\n")
+	for _, entry := range e.Trace {
+		if entry.Position.IsValid() {
+			fmt.Fprintf(&b, "  in %s, at %s (%s)\n", entry.Name, entry.Position, entry.Op)
+		} else {
+			fmt.Fprintf(&b, "  in %s, at %d (%s)\n", entry.Name, entry.IP, entry.Op)
+		}
+	}
+	fmt.Fprintf(&b, "RuntimeError: %s", e.Message)
+
+	return b.String()
+}
+
+func (vm *VM) newError(msg string, values ...any) *RuntimeError {
+	err := &RuntimeError{
+		Message: fmt.Sprintf(msg, values...),
+		Depth:   vm.framePointer,
+	}
+
+	for i := vm.framePointer - 1; i >= 0; i-- {
+		f := vm.frames[i]
+		entry := TraceEntry{Name: "<main>", IP: f.ip}
+		if i > 0 {
+			entry.Name = f.closure.Value.Name
+		}
+		if f.ip >= 0 && f.ip < len(f.tape) {
+			entry.Op = f.tape[f.ip].OpCode
+		}
+		entry.Position, _ = f.lines.Lookup(f.ip)
+		err.Trace = append(err.Trace, entry)
+	}
+
+	if len(err.Trace) > 0 {
+		err.Op = err.Trace[0].Op
+		err.IP = err.Trace[0].IP
+		err.Position = err.Trace[0].Position
+	}
+
+	return err
+}
+
+// loadError reports an instruction of fn, which is rejected before the program runs.
+// The trace holds only fn, as nothing has been called yet.
+func loadError(fn object.Function, ip int, msg string, values ...any) *RuntimeError {
+	entry := TraceEntry{Name: fn.Name, Op: fn.Value[ip].OpCode, IP: ip}
+	entry.Position, _ = fn.Lines.Lookup(ip)
+
+	return &RuntimeError{
+		Message:  fmt.Sprintf(msg, values...),
+		Op:       entry.Op,
+		IP:       ip,
+		Position: entry.Position,
+		Trace:    []TraceEntry{entry},
+	}
+}
+
+// fail aborts the current instruction, Run recovers and either throws it to a handler or returns it.
+func (vm *VM) fail(msg string, values ...any) {
+	panic(vm.newError(msg, values...))
+}
+
+// recoverError converts a panic raised while executing into a RuntimeError.
+func (vm *VM) recoverError(r any) *RuntimeError {
+	switch r := r.(type) {
+	case *RuntimeError:
+		return r
+	case runtime.Error:
+		return vm.newError("Internal error: %s", r)
+	default:
+		panic(r)
+	}
+}
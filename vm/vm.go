@@ -1,27 +1,37 @@
 package vm
 
 import (
+	"cmp"
+	"fmt"
 	"maps"
 	"reflect"
 
 	"slices"
+	"strings"
 
 	"github.com/pspiagicw/fenc/code"
 	"github.com/pspiagicw/fenc/emitter"
 	"github.com/pspiagicw/fenc/object"
-	"github.com/pspiagicw/goreland"
 )
 
 const StackSize = 2048
 const MaxFrames = 256
-const MaxLocals = 2048
 
 type Frame struct {
 	tape       []code.Instruction
 	ip         int
 	locals     []object.Object
 	oldPointer int
-	free       []object.Object
+	free       []*object.Cell
+	closure    object.Closure
+	lines      code.LineTable
+}
+
+// handler is registered by SETUP_TRY, it records where to resume if a value is thrown.
+type handler struct {
+	ip           int
+	framePointer int
+	stackPointer int
 }
 
 type VM struct {
@@ -31,7 +41,8 @@ type VM struct {
 	stackPointer int
 	constants    []object.Object
 	globals      map[int]object.Object
-	builtins     map[int]object.Builtin
+	builtins     []object.Builtin
+	handlers     []handler
 }
 
 func NewFrame(tape []code.Instruction) *Frame {
@@ -50,14 +61,23 @@ func (vm *VM) popFrame() *Frame {
 	return vm.frames[vm.framePointer]
 }
 func (vm *VM) pushFrame(f *Frame) {
+	if vm.framePointer >= MaxFrames {
+		vm.fail("Frame overflow!")
+	}
 	vm.frames[vm.framePointer] = f
 	vm.framePointer++
 }
 
-func NewVM(bytecode emitter.ByteCode, builtins map[string]object.Builtin) *VM {
+// NewVM binds the builtins referenced by the bytecode by name, extra builtins are ignored.
+func NewVM(bytecode emitter.ByteCode, builtins map[string]object.Builtin) (*VM, error) {
+	bound, err := bindBuiltins(bytecode.Builtins, builtins)
+	if err != nil {
+		return nil, err
+	}
+
 	frames := make([]*Frame, MaxFrames)
 	frames[0] = NewFrame(bytecode.Tape)
-	sortedBuiltins := convertedMap(builtins)
+	frames[0].lines = bytecode.Lines
 	return &VM{
 		frames:       frames,
 		stack:        make([]object.Object, StackSize),
@@ -65,22 +85,93 @@ func NewVM(bytecode emitter.ByteCode, builtins map[string]object.Builtin) *VM {
 		constants:    bytecode.Constants,
 		globals:      map[int]object.Object{},
 		framePointer: 1,
-		builtins:     sortedBuiltins,
+		builtins:     bound,
+	}, nil
+}
+
+func bindBuiltins(names []string, builtins map[string]object.Builtin) ([]object.Builtin, error) {
+	bound := make([]object.Builtin, len(names))
+	missing := []string{}
+
+	for i, name := range names {
+		b, ok := builtins[name]
+		if !ok {
+			missing = append(missing, name)
+		}
+		b.Name = name
+		bound[i] = b
+	}
+
+	if len(missing) != 0 {
+		return nil, fmt.Errorf("Missing builtins: %s", strings.Join(missing, ", "))
 	}
+
+	return bound, nil
 }
+func (vm *VM) Run() error {
+	err := vm.validate()
+	if err != nil {
+		return err
+	}
 
-func convertedMap(builtins map[string]object.Builtin) map[int]object.Builtin {
-	sortedKeys := slices.Sorted(maps.Keys(builtins))
+	for {
+		err := vm.run()
+		if err == nil {
+			return nil
+		}
+		if len(vm.handlers) == 0 {
+			return err
+		}
+
+		// Runtime errors can be caught like any thrown value.
+		vm.throw(object.Error{Message: err.Message})
+		vm.currentFrame().ip += 1
+	}
+}
 
-	converted := make(map[int]object.Builtin, len(builtins))
+// validate checks that every instruction, including the ones of function constants, is defined and has its operands.
+func (vm *VM) validate() *RuntimeError {
+	// The main program has no locals.
+	functions := []object.Function{{Name: "<main>", Value: vm.frames[0].tape, Lines: vm.frames[0].lines}}
+	for _, constant := range vm.constants {
+		if fn, ok := constant.(object.Function); ok {
+			functions = append(functions, fn)
+		}
+	}
 
-	for i, key := range sortedKeys {
-		converted[i] = builtins[key]
+	for _, fn := range functions {
+		for ip, ins := range fn.Value {
+			def, err := code.Lookup(ins.OpCode)
+			if err != nil {
+				return loadError(fn, ip, "Invalid Op at %d: %s", ip, ins.OpCode)
+			}
+			if len(ins.Args) != len(def.OperandWidths) {
+				return loadError(fn, ip, "Malformed %s at %d: expected %d operands, got %d", ins.OpCode, ip, len(def.OperandWidths), len(ins.Args))
+			}
+			if ins.OpCode == code.BUILTIN && (ins.Args[0] < 0 || ins.Args[0] >= len(vm.builtins)) {
+				return loadError(fn, ip, "Builtin %d at %d is not in the builtin table", ins.Args[0], ip)
+			}
+			switch ins.OpCode {
+			case code.LOAD_LOCAL, code.STORE_LOCAL, code.CAPTURE_LOCAL, code.DEFINE_LOCAL:
+				numLocals := max(fn.NumLocals, fn.Arity)
+				if ins.Args[0] < 0 || ins.Args[0] >= numLocals {
+					return loadError(fn, ip, "Local %d at %d is out of range, %s has %d locals", ins.Args[0], ip, fn.Name, numLocals)
+				}
+			}
+		}
 	}
 
-	return converted
+	return nil
 }
-func (vm *VM) Run() {
+
+// run executes until the program ends, or an instruction fails.
+func (vm *VM) run() (err *RuntimeError) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = vm.recoverError(r)
+		}
+	}()
+
 	for vm.currentFrame().ip < len(vm.currentFrame().tape) {
 		ins := vm.currentFrame().tape[vm.currentFrame().ip]
 		switch ins.OpCode {
@@ -138,6 +229,8 @@ func (vm *VM) Run() {
 			vm.Jump(ins.Args[0])
 		case code.JUMP_FALSE:
 			vm.JumpFalse(ins.Args[0])
+		case code.JUMP_TRUE:
+			vm.JumpTrue(ins.Args[0])
 		case code.STORE_GLOBAL:
 			vm.Store(ins.Args[0])
 		case code.LOAD_GLOBAL:
@@ -146,6 +239,10 @@ func (vm *VM) Run() {
 			vm.Closure(ins.Args[0], ins.Args[1])
 		case code.CALL:
 			vm.Call(ins.Args[0])
+		case code.CALL_KW:
+			vm.CallKw(ins.Args[0], ins.Args[1])
+		case code.TAIL_CALL:
+			vm.TailCall(ins.Args[0])
 		case code.RETURN:
 			vm.Return()
 		case code.RETURN_VALUE:
@@ -154,8 +251,18 @@ func (vm *VM) Run() {
 			vm.LoadLocal(ins.Args[0])
 		case code.LOAD_FREE:
 			vm.LoadFree(ins.Args[0])
+		case code.CURRENT_CLOSURE:
+			vm.CurrentClosure()
+		case code.STORE_FREE:
+			vm.StoreFree(ins.Args[0])
+		case code.CAPTURE_LOCAL:
+			vm.CaptureLocal(ins.Args[0])
+		case code.CAPTURE_FREE:
+			vm.CaptureFree(ins.Args[0])
 		case code.STORE_LOCAL:
 			vm.StoreLocal(ins.Args[0])
+		case code.DEFINE_LOCAL:
+			vm.DefineLocal(ins.Args[0])
 		case code.ARRAY:
 			vm.Array(ins.Args[0])
 		case code.INDEX:
@@ -170,12 +277,65 @@ func (vm *VM) Run() {
 			vm.Builtin(ins.Args[0])
 		case code.CLASS:
 			vm.Class()
+		case code.POP:
+			vm.Pop()
+		case code.DUP:
+			vm.Dup()
+		case code.SWAP:
+			vm.Swap()
+		case code.THROW:
+			vm.Throw()
+		case code.SETUP_TRY:
+			vm.SetupTry(ins.Args[0])
+		case code.POP_TRY:
+			vm.PopTry()
+		case code.LEN:
+			vm.Len()
+		case code.ITER:
+			vm.Iter()
 		default:
-			goreland.LogFatal("Invalid Op: %s", ins.OpCode)
+			vm.fail("Invalid Op: %s", ins.OpCode)
 		}
 		vm.currentFrame().ip += 1
 	}
+
+	return nil
+}
+func (vm *VM) SetupTry(pos int) {
+	h := handler{
+		ip:           pos,
+		framePointer: vm.framePointer,
+		stackPointer: vm.stackPointer,
+	}
+	vm.handlers = append(vm.handlers, h)
+}
+func (vm *VM) PopTry() {
+	vm.handlers = vm.handlers[:len(vm.handlers)-1]
+}
+func (vm *VM) Throw() {
+	o := vm.Pop()
+	vm.throw(o)
+}
+
+// throw unwinds the frames and the stack to the innermost handler, and pushes the thrown value for it.
+func (vm *VM) throw(o object.Object) {
+	if len(vm.handlers) == 0 {
+		err := vm.newError("Uncaught exception: %s", o)
+		err.Value = o
+		panic(err)
+	}
+
+	h := vm.handlers[len(vm.handlers)-1]
+	vm.handlers = vm.handlers[:len(vm.handlers)-1]
+
+	vm.framePointer = h.framePointer
+	vm.stackPointer = h.stackPointer
+	vm.Push(o)
+
+	// The ip will be incremented automatically.
+	vm.currentFrame().ip = h.ip - 1
 }
+
 func (vm *VM) Class() {
 	name := vm.PopString()
 
@@ -213,16 +373,104 @@ func (vm *VM) Access() {
 	key := vm.Pop()
 	hash := vm.PopHash()
 
-	// TODO: Check if key exists
-	val := hash.Values[key]
+	val, ok := hash.Values[key]
+	if !ok {
+		vm.fail("Key not found: %s", key)
+		return
+	}
 
 	vm.Push(val)
 }
+func (vm *VM) Dup() {
+	o := vm.Pop()
+	vm.Push(o)
+	vm.Push(o)
+}
+func (vm *VM) Swap() {
+	r := vm.Pop()
+	l := vm.Pop()
+	vm.Push(r)
+	vm.Push(l)
+}
+func (vm *VM) Len() {
+	o := vm.Pop()
+
+	var length int
+	switch o := o.(type) {
+	case object.Array:
+		length = len(o.Values)
+	case object.Hash:
+		length = len(o.Values)
+	case object.String:
+		length = len(o.Value)
+	default:
+		vm.fail("Can't take length of object: %v", o)
+	}
+
+	vm.Push(object.CreateInt(length))
+}
+
+// Iter converts the object on top of the stack into an array that can be walked by index.
+// Arrays are left as is, hashes are replaced by their keys in a stable order.
+func (vm *VM) Iter() {
+	o := vm.Pop()
+
+	switch o := o.(type) {
+	case object.Array:
+		vm.Push(o)
+	case object.Hash:
+		keys := slices.SortedFunc(maps.Keys(o.Values), compareKeys)
+		vm.Push(object.CreateArray(keys))
+	default:
+		vm.fail("Can't iterate over object: %v", o)
+	}
+}
+
+// compareKeys is a total order over hash keys.
+// Numbers come first and are compared by value, an int before an equal float. The other keys are grouped by type.
+func compareKeys(a, b object.Object) int {
+	if x, ok := a.(object.Int); ok {
+		if y, ok := b.(object.Int); ok {
+			return cmp.Compare(x.Value, y.Value)
+		}
+	}
+
+	x, aNumber := toNumber(a)
+	y, bNumber := toNumber(b)
+	switch {
+	case aNumber && bNumber:
+		return cmp.Or(cmp.Compare(x, y), strings.Compare(string(a.Type()), string(b.Type())))
+	case aNumber:
+		return -1
+	case bNumber:
+		return 1
+	case a.Type() != b.Type():
+		return strings.Compare(string(a.Type()), string(b.Type()))
+	}
+
+	if x, ok := a.(object.String); ok {
+		return strings.Compare(x.Value, b.(object.String).Value)
+	}
+	// Keys are comparable values, so distinct keys of the same type differ in their Go representation.
+	return strings.Compare(fmt.Sprintf("%#v", a), fmt.Sprintf("%#v", b))
+}
+func toNumber(o object.Object) (float64, bool) {
+	switch o := o.(type) {
+	case object.Int:
+		return float64(o.Value), true
+	case object.Float:
+		return float64(o.Value), true
+	}
+	return 0, false
+}
 func (vm *VM) Index() {
 	index := vm.PopInt()
 	arr := vm.PopArray()
 
-	// TODO: Check if index exists.
+	if index.Value < 0 || index.Value >= len(arr.Values) {
+		vm.fail("Index out of range: %d with length %d", index.Value, len(arr.Values))
+		return
+	}
 	val := arr.Values[index.Value]
 
 	vm.Push(val)
@@ -240,14 +488,52 @@ func (vm *VM) Array(count int) {
 }
 func (vm *VM) StoreLocal(id int) {
 	o := vm.Pop()
-	vm.currentFrame().locals[id] = o
+	locals := vm.currentFrame().locals
+
+	// Captured variables are shared with closures, update the cell instead of replacing it.
+	if cell, ok := locals[id].(*object.Cell); ok {
+		cell.Value = o
+		return
+	}
+	locals[id] = o
+}
+
+// DefineLocal binds a new variable to the slot, closures which captured the previous variable keep their cell.
+func (vm *VM) DefineLocal(id int) {
+	vm.currentFrame().locals[id] = object.Null{}
 }
 func (vm *VM) LoadFree(id int) {
-	val := vm.currentFrame().free[id]
-	vm.Push(val)
+	cell := vm.currentFrame().free[id]
+	vm.Push(cell.Value)
+}
+func (vm *VM) StoreFree(id int) {
+	o := vm.Pop()
+	vm.currentFrame().free[id].Value = o
+}
+
+// CaptureLocal promotes the local variable to a cell (if it isn't one yet) and pushes the cell.
+func (vm *VM) CaptureLocal(id int) {
+	locals := vm.currentFrame().locals
+
+	cell, ok := locals[id].(*object.Cell)
+	if !ok {
+		cell = &object.Cell{Value: locals[id]}
+		locals[id] = cell
+	}
+
+	vm.Push(cell)
+}
+func (vm *VM) CaptureFree(id int) {
+	vm.Push(vm.currentFrame().free[id])
+}
+func (vm *VM) CurrentClosure() {
+	vm.Push(vm.currentFrame().closure)
 }
 func (vm *VM) LoadLocal(id int) {
 	o := vm.currentFrame().locals[id]
+	if cell, ok := o.(*object.Cell); ok {
+		o = cell.Value
+	}
 	vm.Push(o)
 }
 func (vm *VM) ReturnValue() {
@@ -258,18 +544,26 @@ func (vm *VM) ReturnValue() {
 func (vm *VM) Return() {
 	f := vm.popFrame()
 	vm.stackPointer = f.oldPointer
+
+	// Drop the handlers of the returning frame.
+	for len(vm.handlers) > 0 && vm.handlers[len(vm.handlers)-1].framePointer > vm.framePointer {
+		vm.handlers = vm.handlers[:len(vm.handlers)-1]
+	}
 }
 func (vm *VM) execBuiltin(o object.Object, numArgs int) {
+	b, ok := o.(object.Builtin)
+	if !ok {
+		vm.fail("Can't cast to builtin")
+	}
+	if b.Arity != nil && !b.Arity.Accepts(numArgs) {
+		vm.fail("%s expects %s arguments, got %d", b.Name, b.Arity, numArgs)
+	}
+
 	args := make([]object.Object, numArgs)
 	for i := numArgs - 1; i >= 0; i-- {
 		args[i] = vm.Pop()
 	}
 
-	b, ok := o.(object.Builtin)
-	if !ok {
-		goreland.LogFatal("Can't cast to builtin")
-	}
-
 	returnValue := b.Internal(args...)
 
 	if returnValue.Type() != object.NULL {
@@ -278,26 +572,76 @@ func (vm *VM) execBuiltin(o object.Object, numArgs int) {
 }
 
 func (vm *VM) execFunction(o object.Object, numArgs int) {
+	newFrame := &Frame{}
+	vm.setupFrame(newFrame, o, numArgs)
+	vm.pushFrame(newFrame)
+}
+
+// setupFrame prepares f to run the closure, with the arguments on top of the stack.
+func (vm *VM) setupFrame(f *Frame, o object.Object, numArgs int) {
 	fn, ok := o.(object.Closure)
 
 	if !ok {
-		goreland.LogFatal("Can't cast object to closure.")
+		vm.fail("Can't cast object to closure.")
+	}
+	if !fn.Value.Arguments().Accepts(numArgs) {
+		vm.fail("%s expects %s arguments, got %d", fn.Value.Name, fn.Value.Arguments(), numArgs)
 	}
 
-	// We set the local-pool to max-locals
-	args := make([]object.Object, MaxLocals)
-	for i := numArgs - 1; i >= 0; i-- {
-		args[i] = vm.Pop()
+	// The locals are carved out of the stack, starting with the arguments which are already in place.
+	base := vm.stackPointer - numArgs
+
+	// Missing optional arguments take their default, extra arguments are packed for the rest parameter.
+	params := fn.Value.Arity + fn.Value.Optional
+	for i := numArgs; i < params; i++ {
+		vm.Push(fn.Defaults[i-fn.Value.Arity])
+	}
+	if fn.Value.Rest {
+		rest := object.Array{Values: slices.Clone(vm.stack[base+params : vm.stackPointer])}
+		vm.stackPointer = base + params
+		vm.Push(rest)
 	}
 
-	newFrame := NewFrame(fn.Value.Value)
-	newFrame.locals = args
+	top := base + max(fn.Value.NumLocals, vm.stackPointer-base)
+	if top >= StackSize {
+		vm.fail("Stack Overflow!")
+	}
+	// Slots may still hold values (or cells) of an earlier frame.
+	clear(vm.stack[vm.stackPointer:top])
+	vm.stackPointer = top
+
+	f.tape = fn.Value.Value
+	f.locals = vm.stack[base:top:top]
 	// The ip will be incremented automatically, thus we need to set it to -1, thus it will be incremented to 0.
-	newFrame.ip = -1
-	newFrame.oldPointer = vm.stackPointer
-	newFrame.free = fn.Free
+	f.ip = -1
+	f.oldPointer = base
+	f.free = fn.Free
+	f.closure = fn
+	f.lines = fn.Value.Lines
+}
 
-	vm.pushFrame(newFrame)
+// TailCall calls a closure in place of the current function, reusing its frame.
+// The arguments are moved down to the start of the frame, replacing its locals.
+func (vm *VM) TailCall(numArgs int) {
+	o := vm.Pop()
+
+	// Builtins don't use a frame, and the main frame can't be replaced.
+	if o.Type() != object.CLOSURE || vm.framePointer == 1 {
+		vm.Push(o)
+		vm.Call(numArgs)
+		return
+	}
+
+	f := vm.currentFrame()
+	copy(vm.stack[f.oldPointer:], vm.stack[vm.stackPointer-numArgs:vm.stackPointer])
+	vm.stackPointer = f.oldPointer + numArgs
+
+	// Drop the handlers of the replaced function.
+	for len(vm.handlers) > 0 && vm.handlers[len(vm.handlers)-1].framePointer >= vm.framePointer {
+		vm.handlers = vm.handlers[:len(vm.handlers)-1]
+	}
+
+	vm.setupFrame(f, o, numArgs)
 }
 func (vm *VM) Call(numArgs int) {
 	o := vm.Pop()
@@ -307,30 +651,98 @@ func (vm *VM) Call(numArgs int) {
 	} else if o.Type() == object.CLOSURE {
 		vm.execFunction(o, numArgs)
 	} else {
-		goreland.LogFatal("Can't execute object of type: %v", o)
+		vm.fail("Can't execute object of type: %v", o)
 	}
 }
+
+// CallKw binds the keyword arguments to the parameters following the positional arguments.
+// The parameters are pushed in order, missing optional ones take their default, and the function is called with all of them.
+func (vm *VM) CallKw(positional int, namesId int) {
+	o := vm.Pop()
+	names, ok := vm.getConstant(namesId).(object.Array)
+	if !ok {
+		vm.fail("Keyword names must be an array, got %v", vm.getConstant(namesId))
+	}
+
+	fn, ok := o.(object.Closure)
+	if !ok {
+		if b, ok := o.(object.Builtin); ok {
+			vm.fail("%s doesn't accept keyword arguments", b.Name)
+		}
+		vm.fail("Can't execute object of type: %v", o)
+	}
+
+	values := make([]object.Object, len(names.Values))
+	for i := len(values) - 1; i >= 0; i-- {
+		values[i] = vm.Pop()
+	}
+
+	// Only the required and optional parameters can be named.
+	params := fn.Value.Arity + fn.Value.Optional
+	bound := make([]object.Object, max(params-positional, 0))
+	for i, o := range names.Values {
+		name, ok := o.(object.String)
+		if !ok {
+			vm.fail("Keyword name must be a string, got %v", o)
+		}
+
+		slot := slices.Index(fn.Value.Params[:min(params, len(fn.Value.Params))], name.Value)
+		if slot == -1 {
+			vm.fail("%s got an unknown keyword argument: %s", fn.Value.Name, name.Value)
+		}
+		if slot < positional || bound[slot-positional] != nil {
+			vm.fail("%s got multiple values for argument: %s", fn.Value.Name, name.Value)
+		}
+		bound[slot-positional] = values[i]
+	}
+
+	for i, value := range bound {
+		slot := positional + i
+		if value == nil {
+			if slot < fn.Value.Arity {
+				vm.fail("%s is missing argument: %s", fn.Value.Name, fn.Value.Params[slot])
+			}
+			value = fn.Defaults[slot-fn.Value.Arity]
+		}
+		vm.Push(value)
+	}
+
+	vm.execFunction(fn, positional+len(bound))
+}
 func (vm *VM) Closure(constId int, numFree int) {
 	fn := vm.getConstant(constId)
 	v, ok := fn.(object.Function)
 	if !ok {
-		goreland.LogFatal("Unable to resolve function from constant pool.")
+		vm.fail("Unable to resolve function from constant pool.")
 	}
 
 	// Load the variables in reverse.
 	// Copy the variables
 	// And reset the stackPointer to treat as if those variables didn't exist.
-	free := make([]object.Object, numFree)
+	free := make([]*object.Cell, numFree)
 	for i := 0; i < numFree; i++ {
-		free[i] = vm.stack[vm.stackPointer-numFree+i]
+		o := vm.stack[vm.stackPointer-numFree+i]
+
+		cell, ok := o.(*object.Cell)
+		if !ok {
+			cell = &object.Cell{Value: o}
+		}
+		free[i] = cell
 	}
 
 	// Reset the stackPointer.
 	vm.stackPointer = vm.stackPointer - numFree
 
+	// The default values were pushed before the variables.
+	defaults := make([]object.Object, v.Optional)
+	for i := v.Optional - 1; i >= 0; i-- {
+		defaults[i] = vm.Pop()
+	}
+
 	closure := object.Closure{
-		Value: v,
-		Free:  free,
+		Value:    v,
+		Free:     free,
+		Defaults: defaults,
 	}
 	vm.Push(closure)
 
@@ -340,7 +752,10 @@ func (vm *VM) Store(id int) {
 	vm.globals[id] = o
 }
 func (vm *VM) Load(id int) {
-	val := vm.globals[id]
+	val, ok := vm.globals[id]
+	if !ok {
+		vm.fail("Global not defined: %d", id)
+	}
 	vm.Push(val)
 }
 func (vm *VM) Jump(pos int) {
@@ -353,6 +768,12 @@ func (vm *VM) JumpFalse(pos int) {
 		vm.Jump(pos)
 	}
 }
+func (vm *VM) JumpTrue(pos int) {
+	v := vm.PopBool()
+	if v.Value == true {
+		vm.Jump(pos)
+	}
+}
 func (vm *VM) AddFloat() {
 	r := vm.PopFloat()
 	l := vm.PopFloat()
@@ -381,6 +802,11 @@ func (vm *VM) DivInt() {
 	r := vm.PopInt()
 	l := vm.PopInt()
 
+	if r.Value == 0 {
+		vm.fail("Division by zero")
+		return
+	}
+
 	vm.Push(object.CreateInt((int)(l.Value / r.Value)))
 }
 func (vm *VM) PopClosure() object.Closure {
@@ -388,7 +814,7 @@ func (vm *VM) PopClosure() object.Closure {
 
 	v, ok := o.(object.Closure)
 	if !ok {
-		goreland.LogFatal("Can't cast object to closure.")
+		vm.fail("Can't cast object to closure.")
 	}
 
 	return v
@@ -517,8 +943,8 @@ func (vm *VM) LteFloat() {
 }
 
 func (vm *VM) Pop() object.Object {
-	if vm.stackPointer < 0 {
-		goreland.LogFatal("Stack underflow!")
+	if vm.stackPointer <= 0 {
+		vm.fail("Stack underflow!")
 	}
 	o := vm.stack[vm.stackPointer-1]
 	vm.stackPointer -= 1
@@ -528,7 +954,7 @@ func (vm *VM) PopInt() object.Int {
 	o := vm.Pop()
 	v, ok := o.(object.Int)
 	if !ok {
-		goreland.LogFatal("Expected object to be Integer, got %v", o)
+		vm.fail("Expected object to be Integer, got %v", o)
 	}
 
 	return v
@@ -537,7 +963,7 @@ func (vm *VM) PopArray() object.Array {
 	o := vm.Pop()
 	v, ok := o.(object.Array)
 	if !ok {
-		goreland.LogFatal("Expected object to be Array, got %v", o)
+		vm.fail("Expected object to be Array, got %v", o)
 	}
 	return v
 }
@@ -546,7 +972,7 @@ func (vm *VM) PopHash() object.Hash {
 	o := vm.Pop()
 	v, ok := o.(object.Hash)
 	if !ok {
-		goreland.LogFatal("Expected object to be Hash, got %v", o)
+		vm.fail("Expected object to be Hash, got %v", o)
 	}
 
 	return v
@@ -555,7 +981,7 @@ func (vm *VM) PopFloat() object.Float {
 	o := vm.Pop()
 	v, ok := o.(object.Float)
 	if !ok {
-		goreland.LogFatal("Expected object to be Float, got %v", o)
+		vm.fail("Expected object to be Float, got %v", o)
 	}
 	return v
 }
@@ -563,7 +989,7 @@ func (vm *VM) PopBool() object.Bool {
 	o := vm.Pop()
 	v, ok := o.(object.Bool)
 	if !ok {
-		goreland.LogFatal("Expected object to be Bool, got %v", o)
+		vm.fail("Expected object to be Bool, got %v", o)
 	}
 	return v
 }
@@ -571,17 +997,20 @@ func (vm *VM) PopString() object.String {
 	o := vm.Pop()
 	v, ok := o.(object.String)
 	if !ok {
-		goreland.LogFatal("Expected object to be String, got %v", o)
+		vm.fail("Expected object to be String, got %v", o)
 	}
 	return v
 }
 func (vm *VM) getConstant(index int) object.Object {
+	if index < 0 || index >= len(vm.constants) {
+		vm.fail("Constant index out of range: %d", index)
+	}
 	return vm.constants[index]
 }
 
 func (vm *VM) Push(o object.Object) {
-	if vm.stackPointer > StackSize {
-		goreland.LogFatal("Stack Overflow!")
+	if vm.stackPointer >= StackSize {
+		vm.fail("Stack Overflow!")
 	}
 
 	vm.stack[vm.stackPointer] = o
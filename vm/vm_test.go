@@ -2,10 +2,12 @@ package vm
 
 import (
 	"fmt"
+	"math/rand/v2"
+	"slices"
 	"testing"
 
 	"github.com/alecthomas/assert/v2"
-	"github.com/pspiagicw/fenc/dump"
+	"github.com/pspiagicw/fenc/code"
 	"github.com/pspiagicw/fenc/emitter"
 	"github.com/pspiagicw/fenc/object"
 )
@@ -279,6 +281,112 @@ func TestNeqBool(t *testing.T) {
 	testVM(t, e, object.CreateBool(true))
 }
 
+func pushBool(value bool) emitter.CompileFunc {
+	return func(e *emitter.Emitter) error {
+		e.PushBool(value)
+		return nil
+	}
+}
+
+// markEvaluated records that the operand was evaluated, then pushes value.
+func markEvaluated(value bool) emitter.CompileFunc {
+	return func(e *emitter.Emitter) error {
+		e.PushBool(true)
+		e.Store("evaluated")
+		e.PushBool(value)
+		return nil
+	}
+}
+
+func TestAnd(t *testing.T) {
+	tests := []struct {
+		left     bool
+		right    bool
+		expected bool
+	}{
+		{true, true, true},
+		{true, false, false},
+		{false, true, false},
+		{false, false, false},
+	}
+
+	for _, tt := range tests {
+		e := emitter.NewEmitter(builtins)
+		e.And(pushBool(tt.left), pushBool(tt.right))
+		testVM(t, e, object.CreateBool(tt.expected))
+	}
+}
+
+func TestOr(t *testing.T) {
+	tests := []struct {
+		left     bool
+		right    bool
+		expected bool
+	}{
+		{true, true, true},
+		{true, false, true},
+		{false, true, true},
+		{false, false, false},
+	}
+
+	for _, tt := range tests {
+		e := emitter.NewEmitter(builtins)
+		e.Or(pushBool(tt.left), pushBool(tt.right))
+		testVM(t, e, object.CreateBool(tt.expected))
+	}
+}
+
+func TestAnd_ShortCircuit(t *testing.T) {
+	e := emitter.NewEmitter(builtins)
+	e.PushBool(false)
+	e.Store("evaluated")
+
+	e.And(pushBool(false), markEvaluated(true))
+	e.Store("result")
+	e.Load("evaluated")
+
+	testVM(t, e, object.CreateBool(false))
+}
+
+func TestOr_ShortCircuit(t *testing.T) {
+	e := emitter.NewEmitter(builtins)
+	e.PushBool(false)
+	e.Store("evaluated")
+
+	e.Or(pushBool(true), markEvaluated(false))
+	e.Store("result")
+	e.Load("evaluated")
+
+	testVM(t, e, object.CreateBool(false))
+}
+
+func TestAnd_GuardsAccess(t *testing.T) {
+	// arr != [] and arr[0] == 1, with an empty array.
+	e := emitter.NewEmitter(builtins)
+	e.Array(0)
+	e.Store("arr")
+
+	e.And(
+		func(e *emitter.Emitter) error {
+			e.Load("arr")
+			e.Len()
+			e.PushInt(0)
+			e.GtInt()
+			return nil
+		},
+		func(e *emitter.Emitter) error {
+			e.Load("arr")
+			e.PushInt(0)
+			e.Index()
+			e.PushInt(1)
+			e.Eq()
+			return nil
+		},
+	)
+
+	testVM(t, e, object.CreateBool(false))
+}
+
 // ==========================
 // String operations
 // ==========================
@@ -399,592 +507,3312 @@ func TestIf_Nested(t *testing.T) {
 	testVM(t, e, object.CreateInt(222))
 }
 
-func TestGlobalIntStoreLoad(t *testing.T) {
-	e := emitter.NewEmitter(builtins)
-	e.PushInt(42)
-	e.Store("x")
-	e.PushInt(10)
-	e.Load("x")
+func grade(e *emitter.Emitter, score int) error {
+	branch := func(min int, result string) emitter.CondBranch {
+		return emitter.CondBranch{
+			Cond: func(e *emitter.Emitter) error {
+				e.Load("score")
+				e.PushInt(min)
+				e.GteInt()
+				return nil
+			},
+			Body: func(e *emitter.Emitter) error {
+				e.PushString(result)
+				return nil
+			},
+		}
+	}
 
-	expected := object.CreateInt(42)
-	testVM(t, e, expected)
+	e.PushInt(score)
+	e.Store("score")
+	return e.Cond(
+		[]emitter.CondBranch{
+			branch(90, "A"),
+			branch(75, "B"),
+			branch(50, "C"),
+		},
+		func(e *emitter.Emitter) error {
+			e.PushString("F")
+			return nil
+		},
+	)
 }
 
-// update existing variable
-func TestGlobalVariableOverwrite(t *testing.T) {
-	e := emitter.NewEmitter(builtins)
-	e.PushInt(10)
-	e.Store("x")
-	e.PushInt(99)
-	e.Store("x")
-	e.PushInt(10)
-	e.Load("x")
+func TestCond(t *testing.T) {
+	tests := []struct {
+		score    int
+		expected string
+	}{
+		{95, "A"},
+		{80, "B"},
+		{50, "C"},
+		{10, "F"},
+	}
 
-	expected := object.CreateInt(99)
-	testVM(t, e, expected)
+	for _, tt := range tests {
+		e := emitter.NewEmitter(builtins)
+		grade(e, tt.score)
+		testVM(t, e, object.CreateString(tt.expected))
+	}
 }
 
-// multiple variables at once
-func TestGlobalMultipleVariables(t *testing.T) {
+func TestCond_NoMatch(t *testing.T) {
 	e := emitter.NewEmitter(builtins)
-	e.PushInt(7)
-	e.Store("a")
-	e.PushInt(8)
-	e.Store("b")
-
-	e.PushInt(2)
-	e.Load("a")
-	e.Load("b")
-	e.AddInt()
+	e.Cond(
+		[]emitter.CondBranch{
+			{
+				Cond: func(e *emitter.Emitter) error {
+					e.PushBool(false)
+					return nil
+				},
+				Body: func(e *emitter.Emitter) error {
+					e.PushInt(1)
+					return nil
+				},
+			},
+		},
+		nil,
+	)
 
-	expected := object.CreateInt(15)
-	testVM(t, e, expected)
+	testVMStackEmpty(t, e)
 }
 
-// variable reuse and reassign after computation
-func TestGlobalReuseAfterComputation(t *testing.T) {
+func TestWhile(t *testing.T) {
 	e := emitter.NewEmitter(builtins)
-	e.PushInt(5)
-	e.Store("x")
-	e.PushInt(3)
+	e.PushInt(0)
+	e.Store("i")
+	e.PushInt(0)
+	e.Store("sum")
 
-	e.Load("x")
-	e.PushInt(3)
-	e.AddInt()
-	e.Store("x")
-	e.PushInt(999)
+	e.While(
+		func(e *emitter.Emitter) error {
+			e.Load("i")
+			e.PushInt(10)
+			e.LtInt()
+			return nil
+		},
+		func(e *emitter.Emitter) error {
+			e.Load("i")
+			e.PushInt(1)
+			e.AddInt()
+			e.Store("i")
 
-	e.Load("x")
+			e.Load("sum")
+			e.Load("i")
+			e.AddInt()
+			e.Store("sum")
+			return nil
+		},
+	)
+	e.Load("sum")
 
-	expected := object.CreateInt(8)
-	testVM(t, e, expected)
+	testVM(t, e, object.CreateInt(55))
 }
 
-func TestFunction(t *testing.T) {
+func TestWhile_FalseCondition(t *testing.T) {
 	e := emitter.NewEmitter(builtins)
-	e.Function("test", []string{}, func(e *emitter.Emitter) error {
-		e.PushInt(2)
-		e.ReturnValue()
-		return nil
-	})
-	e.Load("test")
-	e.Call(0)
-
-	expected := object.CreateInt(2)
+	e.PushInt(7)
+	e.Store("x")
 
-	testVM(t, e, expected)
+	e.While(
+		func(e *emitter.Emitter) error {
+			e.PushBool(false)
+			return nil
+		},
+		func(e *emitter.Emitter) error {
+			e.PushInt(99)
+			e.Store("x")
+			return nil
+		},
+	)
+	e.Load("x")
 
+	testVM(t, e, object.CreateInt(7))
 }
 
-func TestFunctionWithArgs(t *testing.T) {
+func TestWhile_Nested(t *testing.T) {
 	e := emitter.NewEmitter(builtins)
-	e.Function("test", []string{"x", "y"}, func(e *emitter.Emitter) error {
-		e.Load("x")
-		e.Load("y")
-		e.AddInt()
-		e.ReturnValue()
-		return nil
-	})
-	e.PushInt(2)
-	e.PushInt(2)
+	e.PushInt(0)
+	e.Store("count")
+	e.PushInt(0)
+	e.Store("i")
 
-	e.Load("test")
-	e.Call(2)
+	e.While(
+		func(e *emitter.Emitter) error { // outer condition
+			e.Load("i")
+			e.PushInt(3)
+			e.LtInt()
+			return nil
+		},
+		func(e *emitter.Emitter) error { // outer body
+			e.PushInt(0)
+			e.Store("j")
+			err := e.While(
+				func(e *emitter.Emitter) error { // inner condition
+					e.Load("j")
+					e.PushInt(4)
+					e.LtInt()
+					return nil
+				},
+				func(e *emitter.Emitter) error { // inner body
+					e.Load("count")
+					e.PushInt(1)
+					e.AddInt()
+					e.Store("count")
+
+					e.Load("j")
+					e.PushInt(1)
+					e.AddInt()
+					e.Store("j")
+					return nil
+				},
+			)
+			if err != nil {
+				return err
+			}
 
-	expected := object.CreateInt(4)
-	testVM(t, e, expected)
+			e.Load("i")
+			e.PushInt(1)
+			e.AddInt()
+			e.Store("i")
+			return nil
+		},
+	)
+	e.Load("count")
+
+	testVM(t, e, object.CreateInt(12))
 }
 
-func TestLambdaWithNoReturn(t *testing.T) {
+func TestWhile_InClosure(t *testing.T) {
 	e := emitter.NewEmitter(builtins)
-	e.Lambda([]string{}, func(e *emitter.Emitter) error {
+	e.Function("factorial", []string{"n"}, func(e *emitter.Emitter) error {
 		e.PushInt(1)
-		e.PushInt(1)
-		e.Return()
-		return nil
-	})
-	e.Call(0)
+		e.Store("result")
+		err := e.While(
+			func(e *emitter.Emitter) error {
+				e.Load("n")
+				e.PushInt(1)
+				e.GtInt()
+				return nil
+			},
+			func(e *emitter.Emitter) error {
+				e.Load("result")
+				e.Load("n")
+				e.MulInt()
+				e.Store("result")
 
-	testVMStackEmpty(t, e)
-}
-func TestLambdaWithReturn(t *testing.T) {
-	e := emitter.NewEmitter(builtins)
-	e.PushInt(1)
-	e.PushInt(1)
-	e.Lambda([]string{"x", "y"}, func(e *emitter.Emitter) error {
-		e.Load("x")
-		e.Load("y")
-		e.AddInt()
+				e.Load("n")
+				e.PushInt(1)
+				e.SubInt()
+				e.Store("n")
+				return nil
+			},
+		)
+		if err != nil {
+			return err
+		}
+		e.Load("result")
 		e.ReturnValue()
 		return nil
 	})
-	e.Call(2)
-	expected := object.CreateInt(2)
 
-	testVM(t, e, expected)
-}
+	e.PushInt(5)
+	e.Load("factorial")
+	e.Call(1)
 
-func TestFunctionWithReturn(t *testing.T) {
+	testVM(t, e, object.CreateInt(120))
 }
 
-func TestClosure(t *testing.T) {
+func TestWhile_CapturedVariable(t *testing.T) {
 	e := emitter.NewEmitter(builtins)
-	e.Function("newClosure", []string{"a"}, func(e *emitter.Emitter) error {
-		e.Lambda([]string{}, func(e *emitter.Emitter) error {
-			e.Load("a")
+	e.Function("repeat", []string{"times"}, func(e *emitter.Emitter) error {
+		e.Lambda([]string{"x"}, func(e *emitter.Emitter) error {
+			e.PushInt(0)
+			e.Store("i")
+			err := e.While(
+				func(e *emitter.Emitter) error {
+					e.Load("i")
+					e.Load("times")
+					e.LtInt()
+					return nil
+				},
+				func(e *emitter.Emitter) error {
+					e.Load("x")
+					e.Load("x")
+					e.AddInt()
+					e.Store("x")
+
+					e.Load("i")
+					e.PushInt(1)
+					e.AddInt()
+					e.Store("i")
+					return nil
+				},
+			)
+			if err != nil {
+				return err
+			}
+			e.Load("x")
 			e.ReturnValue()
 			return nil
 		})
 		e.ReturnValue()
 		return nil
 	})
-	e.PushInt(99)
-	e.Load("newClosure")
-	e.Call(1)
-	e.Store("closure")
-	e.Load("closure")
-	e.Call(0)
 
-	expected := object.CreateInt(99)
+	e.PushInt(4)
+	e.Load("repeat")
+	e.Call(1)
+	e.Store("doubler")
 
-	testVM(t, e, expected)
+	e.PushInt(3)
+	e.Load("doubler")
+	e.Call(1)
 
+	testVM(t, e, object.CreateInt(48))
 }
-func TestComplexClosure(t *testing.T) {
+
+func TestWhile_Break(t *testing.T) {
 	e := emitter.NewEmitter(builtins)
-	e.Function("newAdder", []string{"a", "b"}, func(e *emitter.Emitter) error {
-		e.Lambda([]string{"c"}, func(e *emitter.Emitter) error {
-			e.Load("a")
-			e.Load("b")
-			e.Load("c")
-			e.AddInt()
-			e.AddInt()
-			e.ReturnValue()
-			return nil
-		})
-		e.ReturnValue()
-		return nil
-	})
+	e.PushInt(0)
+	e.Store("i")
 
-	e.PushInt(1)
-	e.PushInt(2)
-	e.Load("newAdder")
-	e.Call(2)
-	e.Store("adder")
-	e.PushInt(8)
-	e.Load("adder")
-	e.Call(1)
-
-	// b, c := e.Bytecode()
-	// dump.Dump(b)
-	//
-	// dump.Constants(c)
+	e.While(
+		func(e *emitter.Emitter) error {
+			e.PushBool(true)
+			return nil
+		},
+		func(e *emitter.Emitter) error {
+			e.Load("i")
+			e.PushInt(1)
+			e.AddInt()
+			e.Store("i")
 
-	expected := object.CreateInt(11)
+			return e.If(
+				func(e *emitter.Emitter) error {
+					e.Load("i")
+					e.PushInt(7)
+					e.Eq()
+					return nil
+				},
+				func(e *emitter.Emitter) error {
+					e.Break()
+					return nil
+				},
+				nil,
+			)
+		},
+	)
+	e.Load("i")
 
-	testVM(t, e, expected)
+	testVM(t, e, object.CreateInt(7))
 }
 
-func TestComplexClosure2(t *testing.T) {
+func TestWhile_Continue(t *testing.T) {
+	// Sum only the odd numbers below 10.
 	e := emitter.NewEmitter(builtins)
-	e.Function("newAdder", []string{"a", "b"}, func(e *emitter.Emitter) error {
-		e.Load("a")
-		e.Load("b")
-		e.AddInt()
-		e.Store("c")
-		e.Lambda([]string{"d"}, func(e *emitter.Emitter) error {
-			e.Load("d")
-			e.Load("c")
+	e.PushInt(0)
+	e.Store("i")
+	e.PushInt(0)
+	e.Store("sum")
+
+	e.While(
+		func(e *emitter.Emitter) error {
+			e.Load("i")
+			e.PushInt(10)
+			e.LtInt()
+			return nil
+		},
+		func(e *emitter.Emitter) error {
+			e.Load("i")
+			e.PushInt(1)
 			e.AddInt()
-			e.ReturnValue()
+			e.Store("i")
+
+			err := e.If(
+				func(e *emitter.Emitter) error {
+					e.Load("i")
+					e.PushInt(2)
+					e.DivInt()
+					e.PushInt(2)
+					e.MulInt()
+					e.Load("i")
+					e.Eq()
+					return nil
+				},
+				func(e *emitter.Emitter) error {
+					e.Continue()
+					return nil
+				},
+				nil,
+			)
+			if err != nil {
+				return err
+			}
+
+			e.Load("sum")
+			e.Load("i")
+			e.AddInt()
+			e.Store("sum")
 			return nil
-		})
-		e.ReturnValue()
-		return nil
-	})
+		},
+	)
+	e.Load("sum")
+
+	testVM(t, e, object.CreateInt(25))
+}
+
+func TestLoop_Break(t *testing.T) {
+	e := emitter.NewEmitter(builtins)
 	e.PushInt(1)
-	e.PushInt(2)
-	e.Load("newAdder")
-	e.Call(2)
-	e.Store("adder")
-	e.PushInt(8)
-	e.Load("adder")
-	e.Call(1)
+	e.Store("x")
 
-	expected := object.CreateInt(11)
+	e.Loop(func(e *emitter.Emitter) error {
+		e.Load("x")
+		e.PushInt(2)
+		e.MulInt()
+		e.Store("x")
 
-	testVM(t, e, expected)
+		return e.If(
+			func(e *emitter.Emitter) error {
+				e.Load("x")
+				e.PushInt(100)
+				e.GtInt()
+				return nil
+			},
+			func(e *emitter.Emitter) error {
+				e.Break()
+				return nil
+			},
+			nil,
+		)
+	})
+	e.Load("x")
+
+	testVM(t, e, object.CreateInt(128))
 }
 
-func TestWeirdClosure(t *testing.T) {
+func TestLoop_NestedBreak(t *testing.T) {
+	// Breaking out of the inner loop must not leave the outer one.
 	e := emitter.NewEmitter(builtins)
-	e.Function("newAdderOuter", []string{"a", "b"}, func(e *emitter.Emitter) error {
-		e.Load("a")
-		e.Load("b")
-		e.AddInt()
-		e.Store("c")
-		e.Lambda([]string{"d"}, func(e *emitter.Emitter) error {
-			e.Load("d")
-			e.Load("c")
+	e.PushInt(0)
+	e.Store("count")
+	e.PushInt(0)
+	e.Store("i")
+
+	e.While(
+		func(e *emitter.Emitter) error {
+			e.Load("i")
+			e.PushInt(5)
+			e.LtInt()
+			return nil
+		},
+		func(e *emitter.Emitter) error {
+			e.Load("i")
+			e.PushInt(1)
 			e.AddInt()
-			e.Store("e")
-			e.Lambda([]string{"f"}, func(e *emitter.Emitter) error {
-				e.Load("e")
-				e.Load("f")
+			e.Store("i")
+
+			return e.Loop(func(e *emitter.Emitter) error {
+				e.Load("count")
+				e.PushInt(1)
 				e.AddInt()
-				e.ReturnValue()
+				e.Store("count")
+				e.Break()
 				return nil
 			})
-			e.ReturnValue()
-			return nil
-		})
-		e.ReturnValue()
+		},
+	)
+	e.Load("count")
+
+	testVM(t, e, object.CreateInt(5))
+}
+
+func pushInt(value int) emitter.CompileFunc {
+	return func(e *emitter.Emitter) error {
+		e.PushInt(value)
 		return nil
-	})
-	e.PushInt(1)
-	e.PushInt(2)
-	e.Load("newAdderOuter")
-	e.Call(2)
-	e.Store("newAdderInner")
-	e.PushInt(3)
-	e.Load("newAdderInner")
-	e.Call(1)
-	e.Store("adder")
-	e.PushInt(8)
-	e.Load("adder")
-	e.Call(1)
+	}
+}
 
-	// b, c := e.Bytecode()
-	// dump.Dump(b)
-	// dump.Constants(c)
+func addTo(name string, value emitter.CompileFunc) emitter.CompileFunc {
+	return func(e *emitter.Emitter) error {
+		e.Load(name)
+		err := value(e)
+		if err != nil {
+			return err
+		}
+		e.AddInt()
+		e.Store(name)
+		return nil
+	}
+}
 
-	expected := object.CreateInt(14)
+func loadVar(name string) emitter.CompileFunc {
+	return func(e *emitter.Emitter) error {
+		e.Load(name)
+		return nil
+	}
+}
 
-	testVM(t, e, expected)
+func TestForRange(t *testing.T) {
+	e := emitter.NewEmitter(builtins)
+	e.PushInt(0)
+	e.Store("sum")
 
+	e.ForRange("i", pushInt(1), pushInt(10), nil, addTo("sum", loadVar("i")))
+	e.Load("sum")
+
+	testVM(t, e, object.CreateInt(55))
 }
-func TestBasicRecursion(t *testing.T) {
-	t.Skip()
+
+func TestForRange_Step(t *testing.T) {
 	e := emitter.NewEmitter(builtins)
-	e.Function("countDown", []string{"x"}, func(e *emitter.Emitter) error {
-		e.If(
-			func(e *emitter.Emitter) error {
-				e.Load("x")
-				e.PushInt(0)
-				e.Eq()
-				return nil
-			},
-			func(e *emitter.Emitter) error {
-				e.PushInt(0)
-				e.Return()
-				return nil
-			},
-			func(e *emitter.Emitter) error {
-				e.Load("x")
-				e.PushInt(1)
-				e.SubInt()
+	e.PushInt(0)
+	e.Store("sum")
 
-				e.Load("countDown")
-				e.Call(1)
+	// 0 + 3 + 6 + 9
+	e.ForRange("i", pushInt(0), pushInt(10), pushInt(3), addTo("sum", loadVar("i")))
+	e.Load("sum")
 
-				return nil
-			},
-		)
+	testVM(t, e, object.CreateInt(18))
+}
 
-		e.PushInt(1)
-		e.Load("countDown")
-		e.Call(1)
+func TestForRange_Negative(t *testing.T) {
+	e := emitter.NewEmitter(builtins)
+	e.PushString("")
+	e.Store("out")
+
+	e.ForRange("i", pushInt(3), pushInt(1), pushInt(-1), func(e *emitter.Emitter) error {
+		e.Load("out")
+		e.PushString("x")
+		e.AddString()
+		e.Store("out")
 		return nil
 	})
+	e.Load("out")
 
-	expected := object.CreateInt(0)
-
-	testVM(t, e, expected)
+	testVM(t, e, object.CreateString("xxx"))
 }
-func TestRecursion(t *testing.T) {
-	t.Skip()
+
+func TestForRange_Empty(t *testing.T) {
 	e := emitter.NewEmitter(builtins)
-	e.Function("fibonacci", []string{"x"}, func(e *emitter.Emitter) error {
-		return e.If(func(e *emitter.Emitter) error {
-			e.Load("x")
-			e.PushInt(2)
-			e.LtInt()
-			return nil
-		}, func(e *emitter.Emitter) error {
-			e.Load("x")
-			e.ReturnValue()
-			return nil
-		}, func(e *emitter.Emitter) error {
-			e.Load("x")
-			e.PushInt(1)
-			e.SubInt()
+	e.PushInt(0)
+	e.Store("count")
 
-			e.Load("fibonacci")
-			e.Call(1)
+	e.ForRange("i", pushInt(5), pushInt(1), nil, addTo("count", pushInt(1)))
+	e.Load("count")
 
-			e.Load("x")
-			e.PushInt(2)
-			e.SubInt()
+	testVM(t, e, object.CreateInt(0))
+}
 
-			e.Load("fibonacci")
-			e.Call(1)
+func TestForRange_BreakContinue(t *testing.T) {
+	e := emitter.NewEmitter(builtins)
+	e.PushInt(0)
+	e.Store("sum")
 
-			e.AddInt()
+	// Skip 3, stop at 6: 1 + 2 + 4 + 5
+	e.ForRange("i", pushInt(1), pushInt(100), nil, func(e *emitter.Emitter) error {
+		err := e.Cond(
+			[]emitter.CondBranch{
+				{
+					Cond: func(e *emitter.Emitter) error {
+						e.Load("i")
+						e.PushInt(3)
+						e.Eq()
+						return nil
+					},
+					Body: func(e *emitter.Emitter) error {
+						e.Continue()
+						return nil
+					},
+				},
+				{
+					Cond: func(e *emitter.Emitter) error {
+						e.Load("i")
+						e.PushInt(6)
+						e.Eq()
+						return nil
+					},
+					Body: func(e *emitter.Emitter) error {
+						e.Break()
+						return nil
+					},
+				},
+			},
+			nil,
+		)
+		if err != nil {
+			return err
+		}
+		return addTo("sum", loadVar("i"))(e)
+	})
+	e.Load("sum")
 
-			e.ReturnValue()
-			return nil
+	testVM(t, e, object.CreateInt(12))
+}
+
+func TestForRange_Local(t *testing.T) {
+	e := emitter.NewEmitter(builtins)
+	e.Function("sumTo", []string{"n"}, func(e *emitter.Emitter) error {
+		e.PushInt(0)
+		e.Store("sum")
+		err := e.ForRange("i", pushInt(1), loadVar("n"), nil, func(e *emitter.Emitter) error {
+			// Nested loop: add i, i times.
+			return e.ForRange("j", pushInt(1), loadVar("i"), nil, addTo("sum", loadVar("i")))
 		})
+		if err != nil {
+			return err
+		}
+		e.Load("sum")
+		e.ReturnValue()
+		return nil
 	})
-	e.PushInt(10)
-	e.Load("fibonacci")
+
+	// 1 + 4 + 9 + 16
+	e.PushInt(4)
+	e.Load("sumTo")
 	e.Call(1)
 
-	expected := object.CreateInt(13)
+	testVM(t, e, object.CreateInt(30))
+}
 
-	bytecode := e.Bytecode()
+func TestForEach_Array(t *testing.T) {
+	e := emitter.NewEmitter(builtins)
+	e.PushInt(0)
+	e.Store("sum")
 
-	dump.Dump(bytecode.Tape)
-	dump.Constants(bytecode.Constants)
+	e.ForEach("x",
+		func(e *emitter.Emitter) error {
+			e.PushInt(4)
+			e.PushInt(5)
+			e.PushInt(6)
+			e.Array(3)
+			return nil
+		},
+		addTo("sum", loadVar("x")),
+	)
+	e.Load("sum")
 
-	testVM(t, e, expected)
+	testVM(t, e, object.CreateInt(15))
 }
 
-// --------------------------------------------
-// Array Tests
-// --------------------------------------------
-
-// simple integer array creation
-func TestArrayBasic(t *testing.T) {
+func TestForEach_Hash(t *testing.T) {
 	e := emitter.NewEmitter(builtins)
-	e.PushInt(1)
+	e.PushString("b")
 	e.PushInt(2)
+	e.PushString("a")
+	e.PushInt(1)
+	e.PushString("c")
 	e.PushInt(3)
-	e.Array(3)
+	e.Hash(3)
+	e.Store("h")
 
-	expected := object.CreateArray([]object.Object{
-		object.CreateInt(1),
-		object.CreateInt(2),
-		object.CreateInt(3),
+	e.PushString("")
+	e.Store("keys")
+
+	// Keys are visited in sorted order.
+	e.ForEach("k", loadVar("h"), func(e *emitter.Emitter) error {
+		e.Load("keys")
+		e.Load("k")
+		e.AddString()
+		e.Store("keys")
+		return nil
 	})
-	testVM(t, e, expected)
+	e.Load("keys")
+
+	testVM(t, e, object.CreateString("abc"))
 }
 
-// array indexing
-func TestArrayIndex(t *testing.T) {
-	e := emitter.NewEmitter(builtins)
-	e.PushInt(10)
-	e.PushInt(20)
-	e.PushInt(30)
+func TestForEach_HashMixedKeys(t *testing.T) {
+	// 1 and "1" print the same, the order must not depend on the map.
+	for range 20 {
+		e := emitter.NewEmitter(builtins)
+		e.PushString("1")
+		e.PushInt(0)
+		e.PushInt(1)
+		e.PushInt(0)
+		e.Hash(2)
+		e.Emit(code.ITER)
+
+		testVM(t, e, object.CreateArray([]object.Object{
+			object.CreateInt(1),
+			object.CreateString("1"),
+		}))
+	}
+}
+
+func TestForEach_HashNumericKeys(t *testing.T) {
+	e := emitter.NewEmitter(builtins)
+	for _, key := range []int{10, 2, 1} {
+		e.PushInt(key)
+		e.PushInt(0)
+	}
+	e.PushFloat(1.5)
+	e.PushInt(0)
+	e.PushString("a")
+	e.PushInt(0)
+	e.Hash(5)
+	e.Emit(code.ITER)
+
+	testVM(t, e, object.CreateArray([]object.Object{
+		object.CreateInt(1),
+		object.CreateFloat(1.5),
+		object.CreateInt(2),
+		object.CreateInt(10),
+		object.CreateString("a"),
+	}))
+}
+
+func TestCompareKeys(t *testing.T) {
+	// Both floats print 0.123456, all classes print class.
+	keys := []object.Object{
+		object.Class{Name: "B"},
+		object.CreateFloat(0.1234562),
+		object.CreateBool(true),
+		object.Class{Name: "A"},
+		object.CreateFloat(0.1234561),
+		object.Null{},
+		object.CreateBool(false),
+		object.CreateInt(1 << 60),
+		object.CreateInt(1<<60 + 1),
+	}
+
+	for range 20 {
+		rand.Shuffle(len(keys), func(i, j int) {
+			keys[i], keys[j] = keys[j], keys[i]
+		})
+		assert.Equal(t, []object.Object{
+			object.CreateFloat(0.1234561),
+			object.CreateFloat(0.1234562),
+			object.CreateInt(1 << 60),
+			object.CreateInt(1<<60 + 1),
+			object.Class{Name: "A"},
+			object.Class{Name: "B"},
+			object.Null{},
+			object.CreateBool(false),
+			object.CreateBool(true),
+		}, slices.SortedFunc(slices.Values(keys), compareKeys))
+	}
+}
+
+func TestForRange_GlobalShadowed(t *testing.T) {
+	// The loop variable is scoped to the loop, the global with the same name is untouched.
+	e := emitter.NewEmitter(builtins)
+	e.PushInt(100)
+	e.Store("i")
+	e.PushInt(0)
+	e.Store("sum")
+
+	e.ForRange("i", pushInt(1), pushInt(3), nil, addTo("sum", loadVar("i")))
+	e.Load("sum")
+	e.Load("i")
+	e.AddInt()
+
+	testVM(t, e, object.CreateInt(106))
+}
+
+func TestForRange_DeclaredInBody(t *testing.T) {
+	// for i = 1, 3 do local i = 100; count = count + 1 end
+	e := emitter.NewEmitter(builtins)
+	e.PushInt(0)
+	e.Store("count")
+
+	e.ForRange("i", pushInt(1), pushInt(3), nil, func(e *emitter.Emitter) error {
+		e.PushInt(100)
+		e.Declare("i")
+		e.Store("i")
+		return addTo("count", pushInt(1))(e)
+	})
+	e.Load("count")
+
+	testVM(t, e, object.CreateInt(3))
+}
+
+func TestForRange_CapturedPerIteration(t *testing.T) {
+	// Every iteration binds a new variable, the closure of the first one keeps its value.
+	e := emitter.NewEmitter(builtins)
+	e.Function("f", []string{}, func(e *emitter.Emitter) error {
+		err := e.ForRange("i", pushInt(1), pushInt(3), nil, func(e *emitter.Emitter) error {
+			return e.If(
+				func(e *emitter.Emitter) error {
+					e.Load("i")
+					e.PushInt(1)
+					e.Eq()
+					return nil
+				},
+				func(e *emitter.Emitter) error {
+					err := e.Lambda([]string{}, func(e *emitter.Emitter) error {
+						e.Load("i")
+						e.ReturnValue()
+						return nil
+					})
+					e.Store("first")
+					return err
+				},
+				nil,
+			)
+		})
+		if err != nil {
+			return err
+		}
+		e.Load("first")
+		e.Call(0)
+		e.ReturnValue()
+		return nil
+	})
+	e.Load("f")
+	e.Call(0)
+
+	testVM(t, e, object.CreateInt(1))
+}
+
+func TestForEach_CapturedShadowed(t *testing.T) {
+	// The loop variable of the inner function doesn't overwrite the captured x.
+	e := emitter.NewEmitter(builtins)
+	e.Function("f", []string{}, func(e *emitter.Emitter) error {
+		e.PushInt(5)
+		e.Store("x")
+		err := e.Lambda([]string{}, func(e *emitter.Emitter) error {
+			err := e.ForEach("x", func(e *emitter.Emitter) error {
+				e.PushInt(1)
+				e.PushInt(2)
+				e.Array(2)
+				return nil
+			}, func(e *emitter.Emitter) error {
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			e.Load("x")
+			e.ReturnValue()
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		e.Call(0)
+		e.ReturnValue()
+		return nil
+	})
+	e.Load("f")
+	e.Call(0)
+
+	testVM(t, e, object.CreateInt(5))
+}
+
+func TestForEach_CapturedPerIteration(t *testing.T) {
+	// Every iteration binds a new variable, the closure of the first one keeps its element.
+	e := emitter.NewEmitter(builtins)
+	e.Function("f", []string{}, func(e *emitter.Emitter) error {
+		err := e.ForEach("v", func(e *emitter.Emitter) error {
+			e.PushInt(1)
+			e.PushInt(2)
+			e.PushInt(3)
+			e.Array(3)
+			return nil
+		}, func(e *emitter.Emitter) error {
+			return e.If(
+				func(e *emitter.Emitter) error {
+					e.Load("v")
+					e.PushInt(1)
+					e.Eq()
+					return nil
+				},
+				func(e *emitter.Emitter) error {
+					err := e.Lambda([]string{}, func(e *emitter.Emitter) error {
+						e.Load("v")
+						e.ReturnValue()
+						return nil
+					})
+					e.Store("first")
+					return err
+				},
+				nil,
+			)
+		})
+		if err != nil {
+			return err
+		}
+		e.Load("first")
+		e.Call(0)
+		e.ReturnValue()
+		return nil
+	})
+	e.Load("f")
+	e.Call(0)
+
+	testVM(t, e, object.CreateInt(1))
+}
+
+func TestForEach_Closure(t *testing.T) {
+	e := emitter.NewEmitter(builtins)
+	e.Function("total", []string{"values"}, func(e *emitter.Emitter) error {
+		e.PushInt(0)
+		e.Store("sum")
+		err := e.ForEach("v", loadVar("values"), addTo("sum", loadVar("v")))
+		if err != nil {
+			return err
+		}
+		e.Load("sum")
+		e.ReturnValue()
+		return nil
+	})
+
+	e.PushInt(10)
+	e.PushInt(20)
+	e.Array(2)
+	e.Load("total")
+	e.Call(1)
+
+	testVM(t, e, object.CreateInt(30))
+}
+
+func TestLen(t *testing.T) {
+	e := emitter.NewEmitter(builtins)
+	e.PushInt(1)
+	e.PushInt(2)
+	e.Array(2)
+	e.Len()
+
+	testVM(t, e, object.CreateInt(2))
+}
+
+func TestGlobalIntStoreLoad(t *testing.T) {
+	e := emitter.NewEmitter(builtins)
+	e.PushInt(42)
+	e.Store("x")
+	e.PushInt(10)
+	e.Load("x")
+
+	expected := object.CreateInt(42)
+	testVM(t, e, expected)
+}
+
+// update existing variable
+func TestGlobalVariableOverwrite(t *testing.T) {
+	e := emitter.NewEmitter(builtins)
+	e.PushInt(10)
+	e.Store("x")
+	e.PushInt(99)
+	e.Store("x")
+	e.PushInt(10)
+	e.Load("x")
+
+	expected := object.CreateInt(99)
+	testVM(t, e, expected)
+}
+
+// multiple variables at once
+func TestGlobalMultipleVariables(t *testing.T) {
+	e := emitter.NewEmitter(builtins)
+	e.PushInt(7)
+	e.Store("a")
+	e.PushInt(8)
+	e.Store("b")
+
+	e.PushInt(2)
+	e.Load("a")
+	e.Load("b")
+	e.AddInt()
+
+	expected := object.CreateInt(15)
+	testVM(t, e, expected)
+}
+
+// variable reuse and reassign after computation
+func TestGlobalReuseAfterComputation(t *testing.T) {
+	e := emitter.NewEmitter(builtins)
+	e.PushInt(5)
+	e.Store("x")
+	e.PushInt(3)
+
+	e.Load("x")
+	e.PushInt(3)
+	e.AddInt()
+	e.Store("x")
+	e.PushInt(999)
+
+	e.Load("x")
+
+	expected := object.CreateInt(8)
+	testVM(t, e, expected)
+}
+
+func TestFunction(t *testing.T) {
+	e := emitter.NewEmitter(builtins)
+	e.Function("test", []string{}, func(e *emitter.Emitter) error {
+		e.PushInt(2)
+		e.ReturnValue()
+		return nil
+	})
+	e.Load("test")
+	e.Call(0)
+
+	expected := object.CreateInt(2)
+
+	testVM(t, e, expected)
+
+}
+
+func TestFunctionWithArgs(t *testing.T) {
+	e := emitter.NewEmitter(builtins)
+	e.Function("test", []string{"x", "y"}, func(e *emitter.Emitter) error {
+		e.Load("x")
+		e.Load("y")
+		e.AddInt()
+		e.ReturnValue()
+		return nil
+	})
+	e.PushInt(2)
+	e.PushInt(2)
+
+	e.Load("test")
+	e.Call(2)
+
+	expected := object.CreateInt(4)
+	testVM(t, e, expected)
+}
+
+func TestLambdaWithNoReturn(t *testing.T) {
+	e := emitter.NewEmitter(builtins)
+	e.Lambda([]string{}, func(e *emitter.Emitter) error {
+		e.PushInt(1)
+		e.PushInt(1)
+		e.Return()
+		return nil
+	})
+	e.Call(0)
+
+	testVMStackEmpty(t, e)
+}
+func TestLambdaWithReturn(t *testing.T) {
+	e := emitter.NewEmitter(builtins)
+	e.PushInt(1)
+	e.PushInt(1)
+	e.Lambda([]string{"x", "y"}, func(e *emitter.Emitter) error {
+		e.Load("x")
+		e.Load("y")
+		e.AddInt()
+		e.ReturnValue()
+		return nil
+	})
+	e.Call(2)
+	expected := object.CreateInt(2)
+
+	testVM(t, e, expected)
+}
+
+func TestFunctionWithReturn(t *testing.T) {
+}
+
+func TestClosure(t *testing.T) {
+	e := emitter.NewEmitter(builtins)
+	e.Function("newClosure", []string{"a"}, func(e *emitter.Emitter) error {
+		e.Lambda([]string{}, func(e *emitter.Emitter) error {
+			e.Load("a")
+			e.ReturnValue()
+			return nil
+		})
+		e.ReturnValue()
+		return nil
+	})
+	e.PushInt(99)
+	e.Load("newClosure")
+	e.Call(1)
+	e.Store("closure")
+	e.Load("closure")
+	e.Call(0)
+
+	expected := object.CreateInt(99)
+
+	testVM(t, e, expected)
+
+}
+func TestComplexClosure(t *testing.T) {
+	e := emitter.NewEmitter(builtins)
+	e.Function("newAdder", []string{"a", "b"}, func(e *emitter.Emitter) error {
+		e.Lambda([]string{"c"}, func(e *emitter.Emitter) error {
+			e.Load("a")
+			e.Load("b")
+			e.Load("c")
+			e.AddInt()
+			e.AddInt()
+			e.ReturnValue()
+			return nil
+		})
+		e.ReturnValue()
+		return nil
+	})
+
+	e.PushInt(1)
+	e.PushInt(2)
+	e.Load("newAdder")
+	e.Call(2)
+	e.Store("adder")
+	e.PushInt(8)
+	e.Load("adder")
+	e.Call(1)
+
+	// b, c := e.Bytecode()
+	// dump.Dump(b)
+	//
+	// dump.Constants(c)
+
+	expected := object.CreateInt(11)
+
+	testVM(t, e, expected)
+}
+
+func TestComplexClosure2(t *testing.T) {
+	e := emitter.NewEmitter(builtins)
+	e.Function("newAdder", []string{"a", "b"}, func(e *emitter.Emitter) error {
+		e.Load("a")
+		e.Load("b")
+		e.AddInt()
+		e.Store("c")
+		e.Lambda([]string{"d"}, func(e *emitter.Emitter) error {
+			e.Load("d")
+			e.Load("c")
+			e.AddInt()
+			e.ReturnValue()
+			return nil
+		})
+		e.ReturnValue()
+		return nil
+	})
+	e.PushInt(1)
+	e.PushInt(2)
+	e.Load("newAdder")
+	e.Call(2)
+	e.Store("adder")
+	e.PushInt(8)
+	e.Load("adder")
+	e.Call(1)
+
+	expected := object.CreateInt(11)
+
+	testVM(t, e, expected)
+}
+
+func TestWeirdClosure(t *testing.T) {
+	e := emitter.NewEmitter(builtins)
+	e.Function("newAdderOuter", []string{"a", "b"}, func(e *emitter.Emitter) error {
+		e.Load("a")
+		e.Load("b")
+		e.AddInt()
+		e.Store("c")
+		e.Lambda([]string{"d"}, func(e *emitter.Emitter) error {
+			e.Load("d")
+			e.Load("c")
+			e.AddInt()
+			e.Store("e")
+			e.Lambda([]string{"f"}, func(e *emitter.Emitter) error {
+				e.Load("e")
+				e.Load("f")
+				e.AddInt()
+				e.ReturnValue()
+				return nil
+			})
+			e.ReturnValue()
+			return nil
+		})
+		e.ReturnValue()
+		return nil
+	})
+	e.PushInt(1)
+	e.PushInt(2)
+	e.Load("newAdderOuter")
+	e.Call(2)
+	e.Store("newAdderInner")
+	e.PushInt(3)
+	e.Load("newAdderInner")
+	e.Call(1)
+	e.Store("adder")
+	e.PushInt(8)
+	e.Load("adder")
+	e.Call(1)
+
+	// b, c := e.Bytecode()
+	// dump.Dump(b)
+	// dump.Constants(c)
+
+	expected := object.CreateInt(14)
+
+	testVM(t, e, expected)
+
+}
+
+// makeCounter emits a function returning a closure, which increments a captured variable on every call.
+func makeCounter(e *emitter.Emitter) error {
+	return e.Function("makeCounter", []string{}, func(e *emitter.Emitter) error {
+		e.PushInt(0)
+		e.Store("count")
+		e.Lambda([]string{}, func(e *emitter.Emitter) error {
+			e.Load("count")
+			e.PushInt(1)
+			e.AddInt()
+			e.Store("count")
+			e.Load("count")
+			e.ReturnValue()
+			return nil
+		})
+		e.ReturnValue()
+		return nil
+	})
+}
+
+func TestClosure_Counter(t *testing.T) {
+	e := emitter.NewEmitter(builtins)
+	makeCounter(e)
+	e.Load("makeCounter")
+	e.Call(0)
+	e.Store("counter")
+
+	for i := 0; i < 3; i++ {
+		e.Load("counter")
+		e.Call(0)
+		e.Pop()
+	}
+	e.Load("counter")
+	e.Call(0)
+
+	testVM(t, e, object.CreateInt(4))
+}
+
+func TestClosure_IndependentCounters(t *testing.T) {
+	e := emitter.NewEmitter(builtins)
+	makeCounter(e)
+	e.Load("makeCounter")
+	e.Call(0)
+	e.Store("first")
+	e.Load("makeCounter")
+	e.Call(0)
+	e.Store("second")
+
+	e.Load("first")
+	e.Call(0)
+	e.Pop()
+	e.Load("first")
+	e.Call(0)
+	e.Pop()
+
+	e.Load("second")
+	e.Call(0)
+
+	testVM(t, e, object.CreateInt(1))
+}
+
+func TestClosure_SharedCell(t *testing.T) {
+	// Two closures capturing the same variable, and the enclosing function, see each other's updates.
+	e := emitter.NewEmitter(builtins)
+	e.Function("run", []string{}, func(e *emitter.Emitter) error {
+		e.PushInt(0)
+		e.Store("x")
+		e.Lambda([]string{}, func(e *emitter.Emitter) error {
+			e.Load("x")
+			e.PushInt(1)
+			e.AddInt()
+			e.Store("x")
+			e.Return()
+			return nil
+		})
+		e.Store("inc")
+		e.Lambda([]string{}, func(e *emitter.Emitter) error {
+			e.Load("x")
+			e.PushInt(10)
+			e.MulInt()
+			e.Store("x")
+			e.Return()
+			return nil
+		})
+		e.Store("scale")
+
+		e.Load("inc")
+		e.Call(0)
+		e.Load("scale")
+		e.Call(0)
+		e.Load("inc")
+		e.Call(0)
+
+		e.PushInt(5)
+		e.Load("x")
+		e.AddInt()
+		e.Store("x")
+
+		e.Load("x")
+		e.ReturnValue()
+		return nil
+	})
+	e.Load("run")
+	e.Call(0)
+
+	testVM(t, e, object.CreateInt(16))
+}
+
+func TestClosure_NestedStore(t *testing.T) {
+	// The innermost closure updates a variable two functions up.
+	e := emitter.NewEmitter(builtins)
+	e.Function("outer", []string{}, func(e *emitter.Emitter) error {
+		e.PushInt(1)
+		e.Store("x")
+		e.Lambda([]string{}, func(e *emitter.Emitter) error {
+			e.Lambda([]string{}, func(e *emitter.Emitter) error {
+				e.Load("x")
+				e.PushInt(41)
+				e.AddInt()
+				e.Store("x")
+				e.Return()
+				return nil
+			})
+			e.Call(0)
+			e.Return()
+			return nil
+		})
+		e.Call(0)
+		e.Load("x")
+		e.ReturnValue()
+		return nil
+	})
+	e.Load("outer")
+	e.Call(0)
+
+	testVM(t, e, object.CreateInt(42))
+}
+
+func TestMutualRecursion_Local(t *testing.T) {
+	e := emitter.NewEmitter(builtins)
+	e.Function("check", []string{"n"}, func(e *emitter.Emitter) error {
+		err := isEvenOdd(e)
+		if err != nil {
+			return err
+		}
+		e.Load("n")
+		e.Load("isEven")
+		e.Call(1)
+		e.ReturnValue()
+		return nil
+	})
+	e.PushInt(9)
+	e.Load("check")
+	e.Call(1)
+
+	testVM(t, e, object.CreateBool(false))
+}
+
+func TestBlock_Shadowing(t *testing.T) {
+	e := emitter.NewEmitter(builtins)
+	e.PushInt(1)
+	e.Store("x")
+
+	e.Block(func(e *emitter.Emitter) error {
+		e.PushInt(2)
+		e.Declare("x")
+		e.Store("x")
+		e.Load("x")
+		e.Store("inner")
+		return nil
+	})
+
+	e.Load("x")
+	e.PushInt(10)
+	e.MulInt()
+	e.Load("inner")
+	e.AddInt()
+
+	testVM(t, e, object.CreateInt(12))
+}
+
+func TestBlock_Assignment(t *testing.T) {
+	// Without Declare, Store inside a block assigns to the outer variable.
+	e := emitter.NewEmitter(builtins)
+	e.PushInt(1)
+	e.Store("x")
+
+	e.Block(func(e *emitter.Emitter) error {
+		e.PushInt(2)
+		e.Store("x")
+		return nil
+	})
+
+	e.Load("x")
+
+	testVM(t, e, object.CreateInt(2))
+}
+
+func TestBlock_LocalShadowsGlobal(t *testing.T) {
+	e := emitter.NewEmitter(builtins)
+	e.PushInt(1)
+	e.Store("x")
+
+	e.Function("f", []string{}, func(e *emitter.Emitter) error {
+		e.PushInt(100)
+		e.Declare("x")
+		e.Store("x")
+		e.Load("x")
+		e.ReturnValue()
+		return nil
+	})
+	e.Load("f")
+	e.Call(0)
+	e.Load("x")
+	e.AddInt()
+
+	testVM(t, e, object.CreateInt(101))
+}
+
+func TestBlock_InIf(t *testing.T) {
+	e := emitter.NewEmitter(builtins)
+	e.Function("f", []string{"x"}, func(e *emitter.Emitter) error {
+		err := e.If(pushBool(true), func(e *emitter.Emitter) error {
+			return e.Block(func(e *emitter.Emitter) error {
+				e.PushInt(50)
+				e.Declare("x")
+				e.Store("x")
+				return nil
+			})
+		}, nil)
+		if err != nil {
+			return err
+		}
+
+		// The slot of the block variable is reused here.
+		e.PushInt(7)
+		e.Declare("y")
+		e.Store("y")
+
+		e.Load("x")
+		e.Load("y")
+		e.AddInt()
+		e.ReturnValue()
+		return nil
+	})
+	e.PushInt(1)
+	e.Load("f")
+	e.Call(1)
+
+	testVM(t, e, object.CreateInt(8))
+}
+
+func TestBlock_CapturedVariable(t *testing.T) {
+	// A closure keeps the block variable alive, even after its block ended.
+	e := emitter.NewEmitter(builtins)
+	e.Function("f", []string{}, func(e *emitter.Emitter) error {
+		err := e.Block(func(e *emitter.Emitter) error {
+			e.PushInt(42)
+			e.Declare("x")
+			e.Store("x")
+			e.Lambda([]string{}, func(e *emitter.Emitter) error {
+				e.Load("x")
+				e.ReturnValue()
+				return nil
+			})
+			e.Declare("get")
+			e.Store("get")
+			e.Load("get")
+			e.Store("result")
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		e.PushInt(0)
+		e.Declare("y")
+		e.Store("y")
+
+		e.Load("result")
+		e.Call(0)
+		e.ReturnValue()
+		return nil
+	})
+	e.Load("f")
+	e.Call(0)
+
+	testVM(t, e, object.CreateInt(42))
+}
+
+func TestBlock_GlobalCaptured(t *testing.T) {
+	e := emitter.NewEmitter(builtins)
+	e.Block(func(e *emitter.Emitter) error {
+		e.PushInt(42)
+		e.Declare("x")
+		e.Store("x")
+		return e.Function("get", []string{}, func(e *emitter.Emitter) error {
+			e.Load("x")
+			e.ReturnValue()
+			return nil
+		})
+	})
+	e.PushInt(0)
+	e.Declare("y")
+	e.Store("y")
+
+	e.Load("get")
+	e.Call(0)
+
+	testVM(t, e, object.CreateInt(42))
+}
+
+func TestBlock_ReusedSlotCaptured(t *testing.T) {
+	// The slot of a, used in the first block, is captured as b in the second one.
+	e := emitter.NewEmitter(builtins)
+	e.Function("f", []string{}, func(e *emitter.Emitter) error {
+		e.PushInt(0)
+		e.Store("n")
+		err := e.Loop(func(e *emitter.Emitter) error {
+			err := e.Block(func(e *emitter.Emitter) error {
+				e.Declare("a")
+				e.PushInt(999)
+				e.Store("a")
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			err = e.If(
+				func(e *emitter.Emitter) error {
+					e.Load("n")
+					e.PushInt(1)
+					e.Eq()
+					return nil
+				},
+				func(e *emitter.Emitter) error {
+					e.Break()
+					return nil
+				},
+				nil,
+			)
+			if err != nil {
+				return err
+			}
+			err = e.Block(func(e *emitter.Emitter) error {
+				e.Declare("b")
+				e.PushInt(7)
+				e.Store("b")
+				err := e.Lambda([]string{}, func(e *emitter.Emitter) error {
+					e.Load("b")
+					e.ReturnValue()
+					return nil
+				})
+				e.Store("g")
+				return err
+			})
+			e.PushInt(1)
+			e.Store("n")
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		e.Load("g")
+		e.Call(0)
+		e.ReturnValue()
+		return nil
+	})
+	e.Load("f")
+	e.Call(0)
+
+	testVM(t, e, object.CreateInt(7))
+}
+
+func TestBlock_CapturedPerIteration(t *testing.T) {
+	// Each iteration declares a new variable, the closure of the first iteration keeps its own.
+	e := emitter.NewEmitter(builtins)
+	e.Function("f", []string{}, func(e *emitter.Emitter) error {
+		e.PushInt(0)
+		e.Store("n")
+		err := e.While(
+			func(e *emitter.Emitter) error {
+				e.Load("n")
+				e.PushInt(3)
+				e.LtInt()
+				return nil
+			},
+			func(e *emitter.Emitter) error {
+				err := e.Block(func(e *emitter.Emitter) error {
+					e.Declare("v")
+					e.Load("n")
+					e.Store("v")
+					return e.If(
+						func(e *emitter.Emitter) error {
+							e.Load("n")
+							e.PushInt(0)
+							e.Eq()
+							return nil
+						},
+						func(e *emitter.Emitter) error {
+							err := e.Lambda([]string{}, func(e *emitter.Emitter) error {
+								e.Load("v")
+								e.ReturnValue()
+								return nil
+							})
+							e.Store("first")
+							return err
+						},
+						nil,
+					)
+				})
+				e.Load("n")
+				e.PushInt(1)
+				e.AddInt()
+				e.Store("n")
+				return err
+			},
+		)
+		if err != nil {
+			return err
+		}
+		e.Load("first")
+		e.Call(0)
+		e.ReturnValue()
+		return nil
+	})
+	e.Load("f")
+	e.Call(0)
+
+	testVM(t, e, object.CreateInt(0))
+}
+
+func TestBlock_DeclaredIsNull(t *testing.T) {
+	// A declared variable doesn't see the value left in its slot by a previous block.
+	e := emitter.NewEmitter(builtins)
+	e.Function("f", []string{}, func(e *emitter.Emitter) error {
+		err := e.Block(func(e *emitter.Emitter) error {
+			e.Declare("a")
+			e.PushInt(7)
+			e.Store("a")
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		e.Declare("b")
+		e.Load("b")
+		e.Store("result")
+		e.PushInt(1)
+		e.Store("b")
+		e.Load("result")
+		e.ReturnValue()
+		return nil
+	})
+	e.Load("f")
+	e.Call(0)
+
+	testVM(t, e, object.Null{})
+}
+
+func TestBasicRecursion(t *testing.T) {
+	e := emitter.NewEmitter(builtins)
+	e.Function("countDown", []string{"x"}, func(e *emitter.Emitter) error {
+		return e.If(
+			func(e *emitter.Emitter) error {
+				e.Load("x")
+				e.PushInt(0)
+				e.Eq()
+				return nil
+			},
+			func(e *emitter.Emitter) error {
+				e.PushInt(0)
+				e.ReturnValue()
+				return nil
+			},
+			func(e *emitter.Emitter) error {
+				e.Load("x")
+				e.PushInt(1)
+				e.SubInt()
+
+				e.Load("countDown")
+				e.Call(1)
+				e.ReturnValue()
+
+				return nil
+			},
+		)
+	})
+	e.PushInt(1)
+	e.Load("countDown")
+	e.Call(1)
+
+	expected := object.CreateInt(0)
+
+	testVM(t, e, expected)
+}
+func TestRecursion(t *testing.T) {
+	e := emitter.NewEmitter(builtins)
+	fibonacci(e)
+	e.PushInt(10)
+	e.Load("fibonacci")
+	e.Call(1)
+
+	expected := object.CreateInt(55)
+
+	testVM(t, e, expected)
+}
+
+func TestFunction_ReusedLocals(t *testing.T) {
+	e := emitter.NewEmitter(builtins)
+	e.Function("counter", []string{}, func(e *emitter.Emitter) error {
+		e.PushInt(0)
+		e.Store("unused")
+		e.PushInt(1)
+		e.Store("count")
+		e.Lambda([]string{}, func(e *emitter.Emitter) error {
+			e.Load("count")
+			e.ReturnValue()
+			return nil
+		})
+		e.ReturnValue()
+		return nil
+	})
+	e.Function("other", []string{}, func(e *emitter.Emitter) error {
+		e.PushInt(0)
+		e.Store("first")
+		e.PushInt(2)
+		e.Store("second")
+		e.PushInt(0)
+		e.ReturnValue()
+		return nil
+	})
+	e.Load("counter")
+	e.Call(0)
+	e.Store("get")
+
+	// The locals of other occupy the same stack slots, which held the captured count.
+	e.Load("other")
+	e.Call(0)
+	e.Pop()
+
+	e.Load("get")
+	e.Call(0)
+
+	testVM(t, e, object.CreateInt(1))
+}
+
+// connect emits a function with a required, an optional and a rest parameter, returning all of them in an array.
+func connect(e *emitter.Emitter) error {
+	return e.FunctionWithParams("connect", emitter.Params{
+		Required: []string{"host"},
+		Optional: []emitter.Optional{
+			{Name: "port", Default: func(e *emitter.Emitter) error {
+				e.Load("defaultPort")
+				return nil
+			}},
+		},
+		Rest: "options",
+	}, func(e *emitter.Emitter) error {
+		e.Load("host")
+		e.Load("port")
+		e.Load("options")
+		e.Array(3)
+		e.ReturnValue()
+		return nil
+	})
+}
+
+func TestFunction_Params(t *testing.T) {
+	tests := []struct {
+		args     []string
+		expected object.Object
+	}{
+		{
+			[]string{"localhost"},
+			object.CreateArray([]object.Object{
+				object.CreateString("localhost"),
+				object.CreateInt(80),
+				object.CreateArray([]object.Object{}),
+			}),
+		},
+		{
+			[]string{"localhost", "8080"},
+			object.CreateArray([]object.Object{
+				object.CreateString("localhost"),
+				object.CreateString("8080"),
+				object.CreateArray([]object.Object{}),
+			}),
+		},
+		{
+			[]string{"localhost", "8080", "tls", "keepalive"},
+			object.CreateArray([]object.Object{
+				object.CreateString("localhost"),
+				object.CreateString("8080"),
+				object.CreateArray([]object.Object{
+					object.CreateString("tls"),
+					object.CreateString("keepalive"),
+				}),
+			}),
+		},
+	}
+
+	for _, test := range tests {
+		e := emitter.NewEmitter(builtins)
+		e.PushInt(80)
+		e.Store("defaultPort")
+		connect(e)
+		// The default was evaluated when connect was defined.
+		e.PushInt(443)
+		e.Store("defaultPort")
+
+		for _, arg := range test.args {
+			e.PushString(arg)
+		}
+		e.Load("connect")
+		e.Call(len(test.args))
+
+		testVM(t, e, test.expected)
+	}
+}
+
+func TestFunction_DefaultClosure(t *testing.T) {
+	e := emitter.NewEmitter(builtins)
+	e.Function("greeter", []string{"greeting"}, func(e *emitter.Emitter) error {
+		e.LambdaWithParams(emitter.Params{
+			Optional: []emitter.Optional{
+				{Name: "name", Default: func(e *emitter.Emitter) error {
+					e.PushString("world")
+					return nil
+				}},
+			},
+		}, func(e *emitter.Emitter) error {
+			e.Load("greeting")
+			e.Load("name")
+			e.AddString()
+			e.ReturnValue()
+			return nil
+		})
+		e.ReturnValue()
+		return nil
+	})
+	e.PushString("hello, ")
+	e.Load("greeter")
+	e.Call(1)
+	e.Store("greet")
+
+	e.PushString("fenc")
+	e.Load("greet")
+	e.Call(1)
+	e.Load("greet")
+	e.Call(0)
+	e.AddString()
+
+	testVM(t, e, object.CreateString("hello, fenchello, world"))
+}
+
+// draw emits draw(x, y, color = "black"), returning its arguments in an array.
+func draw(e *emitter.Emitter) error {
+	return e.FunctionWithParams("draw", emitter.Params{
+		Required: []string{"x", "y"},
+		Optional: []emitter.Optional{
+			{Name: "color", Default: func(e *emitter.Emitter) error {
+				e.PushString("black")
+				return nil
+			}},
+		},
+	}, func(e *emitter.Emitter) error {
+		e.Load("x")
+		e.Load("y")
+		e.Load("color")
+		e.Array(3)
+		e.ReturnValue()
+		return nil
+	})
+}
+
+func TestCallKw(t *testing.T) {
+	tests := []struct {
+		positional []int
+		names      []string
+		values     []object.Object
+		expected   object.Object
+	}{
+		{
+			[]int{1},
+			[]string{"color", "y"},
+			[]object.Object{object.CreateString("red"), object.CreateInt(2)},
+			object.CreateArray([]object.Object{object.CreateInt(1), object.CreateInt(2), object.CreateString("red")}),
+		},
+		{
+			[]int{},
+			[]string{"y", "x"},
+			[]object.Object{object.CreateInt(2), object.CreateInt(1)},
+			object.CreateArray([]object.Object{object.CreateInt(1), object.CreateInt(2), object.CreateString("black")}),
+		},
+		{
+			[]int{1, 2},
+			[]string{},
+			[]object.Object{},
+			object.CreateArray([]object.Object{object.CreateInt(1), object.CreateInt(2), object.CreateString("black")}),
+		},
+	}
+
+	for _, test := range tests {
+		e := emitter.NewEmitter(builtins)
+		draw(e)
+		for _, value := range test.positional {
+			e.PushInt(value)
+		}
+		for _, value := range test.values {
+			e.Emit(code.PUSH, e.Constant(value))
+		}
+		e.Load("draw")
+		e.CallKw(len(test.positional), test.names)
+
+		testVM(t, e, test.expected)
+	}
+}
+
+func TestCallKw_Rest(t *testing.T) {
+	e := emitter.NewEmitter(builtins)
+	e.PushInt(80)
+	e.Store("defaultPort")
+	connect(e)
+	e.PushString("localhost")
+	e.PushInt(8080)
+	e.Load("connect")
+	e.CallKw(1, []string{"port"})
+
+	testVM(t, e, object.CreateArray([]object.Object{
+		object.CreateString("localhost"),
+		object.CreateInt(8080),
+		object.CreateArray([]object.Object{}),
+	}))
+}
+
+func TestError_CallKw(t *testing.T) {
+	tests := []struct {
+		positional int
+		names      []string
+		expected   string
+	}{
+		{1, []string{"z"}, "draw got an unknown keyword argument: z"},
+		{1, []string{"x"}, "draw got multiple values for argument: x"},
+		{0, []string{"y"}, "draw is missing argument: x"},
+		{4, []string{"color"}, "draw got multiple values for argument: color"},
+	}
+
+	for _, test := range tests {
+		e := emitter.NewEmitter(builtins)
+		draw(e)
+		for i := range test.positional + len(test.names) {
+			e.PushInt(i)
+		}
+		e.Load("draw")
+		e.CallKw(test.positional, test.names)
+
+		testVMError(t, e, test.expected)
+	}
+
+	e := emitter.NewEmitter(builtins)
+	e.PushString("hello")
+	e.Load("print")
+	e.CallKw(0, []string{"value"})
+
+	testVMError(t, e, "print doesn't accept keyword arguments")
+}
+
+// fibonacci emits the naive recursive fibonacci function.
+func fibonacci(e *emitter.Emitter) error {
+	return e.Function("fibonacci", []string{"x"}, func(e *emitter.Emitter) error {
+		return e.If(func(e *emitter.Emitter) error {
+			e.Load("x")
+			e.PushInt(2)
+			e.LtInt()
+			return nil
+		}, func(e *emitter.Emitter) error {
+			e.Load("x")
+			e.ReturnValue()
+			return nil
+		}, func(e *emitter.Emitter) error {
+			e.Load("x")
+			e.PushInt(1)
+			e.SubInt()
+
+			e.Load("fibonacci")
+			e.Call(1)
+
+			e.Load("x")
+			e.PushInt(2)
+			e.SubInt()
+
+			e.Load("fibonacci")
+			e.Call(1)
+
+			e.AddInt()
+
+			e.ReturnValue()
+			return nil
+		})
+	})
+}
+
+// sumTo emits a recursive function computing 1 + 2 + ... + n.
+func sumTo(e *emitter.Emitter) error {
+	return e.Function("sumTo", []string{"n"}, func(e *emitter.Emitter) error {
+		return e.If(func(e *emitter.Emitter) error {
+			e.Load("n")
+			e.PushInt(0)
+			e.Eq()
+			return nil
+		}, func(e *emitter.Emitter) error {
+			e.PushInt(0)
+			e.ReturnValue()
+			return nil
+		}, func(e *emitter.Emitter) error {
+			e.Load("n")
+			e.PushInt(1)
+			e.SubInt()
+			e.Load("sumTo")
+			e.Call(1)
+			e.Load("n")
+			e.AddInt()
+			e.ReturnValue()
+			return nil
+		})
+	})
+}
+
+func TestRecursion_Local(t *testing.T) {
+	e := emitter.NewEmitter(builtins)
+	e.Function("outer", []string{"n"}, func(e *emitter.Emitter) error {
+		err := sumTo(e)
+		if err != nil {
+			return err
+		}
+		e.Load("n")
+		e.Load("sumTo")
+		e.Call(1)
+		e.ReturnValue()
+		return nil
+	})
+	e.PushInt(100)
+	e.Load("outer")
+	e.Call(1)
+
+	testVM(t, e, object.CreateInt(5050))
+}
+
+func TestRecursion_Deep(t *testing.T) {
+	e := emitter.NewEmitter(builtins)
+	sumTo(e)
+	e.PushInt(200)
+	e.Load("sumTo")
+	e.Call(1)
+
+	testVM(t, e, object.CreateInt(20100))
+}
+
+func TestRecursion_CapturedByLambda(t *testing.T) {
+	// A lambda nested in a recursive function can call the function.
+	e := emitter.NewEmitter(builtins)
+	e.Function("countUp", []string{"n"}, func(e *emitter.Emitter) error {
+		return e.If(func(e *emitter.Emitter) error {
+			e.Load("n")
+			e.PushInt(5)
+			e.GteInt()
+			return nil
+		}, func(e *emitter.Emitter) error {
+			e.Load("n")
+			e.ReturnValue()
+			return nil
+		}, func(e *emitter.Emitter) error {
+			e.Lambda([]string{"m"}, func(e *emitter.Emitter) error {
+				e.Load("m")
+				e.PushInt(1)
+				e.AddInt()
+				e.Load("countUp")
+				e.Call(1)
+				e.ReturnValue()
+				return nil
+			})
+			e.Store("next")
+			e.Load("n")
+			e.Load("next")
+			e.Call(1)
+			e.ReturnValue()
+			return nil
+		})
+	})
+	e.PushInt(0)
+	e.Load("countUp")
+	e.Call(1)
+
+	testVM(t, e, object.CreateInt(5))
+}
+
+// isEvenOdd emits a pair of mutually recursive functions.
+func isEvenOdd(e *emitter.Emitter) error {
+	parity := func(name, other string, base bool) error {
+		return e.Function(name, []string{"n"}, func(e *emitter.Emitter) error {
+			return e.If(func(e *emitter.Emitter) error {
+				e.Load("n")
+				e.PushInt(0)
+				e.Eq()
+				return nil
+			}, func(e *emitter.Emitter) error {
+				e.PushBool(base)
+				e.ReturnValue()
+				return nil
+			}, func(e *emitter.Emitter) error {
+				e.Load("n")
+				e.PushInt(1)
+				e.SubInt()
+				e.Load(other)
+				e.Call(1)
+				e.ReturnValue()
+				return nil
+			})
+		})
+	}
+
+	e.Declare("isEven", "isOdd")
+	err := parity("isEven", "isOdd", true)
+	if err != nil {
+		return err
+	}
+	return parity("isOdd", "isEven", false)
+}
+
+func TestMutualRecursion(t *testing.T) {
+	tests := []struct {
+		fn       string
+		n        int
+		expected bool
+	}{
+		{"isEven", 10, true},
+		{"isEven", 7, false},
+		{"isOdd", 7, true},
+		{"isOdd", 0, false},
+		// Far deeper than MaxFrames, the calls are tail calls.
+		{"isEven", 100000, true},
+		{"isOdd", 100001, true},
+	}
+
+	for _, tt := range tests {
+		e := emitter.NewEmitter(builtins)
+		isEvenOdd(e)
+		e.PushInt(tt.n)
+		e.Load(tt.fn)
+		e.Call(1)
+
+		testVM(t, e, object.CreateBool(tt.expected))
+	}
+}
+
+// sum emits a tail recursive function computing acc + 1 + 2 + ... + n.
+func sum(e *emitter.Emitter) error {
+	return e.Function("sum", []string{"n", "acc"}, func(e *emitter.Emitter) error {
+		return e.If(func(e *emitter.Emitter) error {
+			e.Load("n")
+			e.PushInt(0)
+			e.Eq()
+			return nil
+		}, func(e *emitter.Emitter) error {
+			e.Load("acc")
+			e.ReturnValue()
+			return nil
+		}, func(e *emitter.Emitter) error {
+			e.Load("n")
+			e.PushInt(1)
+			e.SubInt()
+			e.Load("acc")
+			e.Load("n")
+			e.AddInt()
+			e.Load("sum")
+			e.Call(2)
+			e.ReturnValue()
+			return nil
+		})
+	})
+}
+
+func TestTailCall(t *testing.T) {
+	e := emitter.NewEmitter(builtins)
+	sum(e)
+	e.PushInt(1000000)
+	e.PushInt(0)
+	e.Load("sum")
+	e.Call(2)
+
+	testVM(t, e, object.CreateInt(500000500000))
+}
+
+func TestTailCall_Builtin(t *testing.T) {
+	available := map[string]object.Builtin{
+		"double": {Internal: func(args ...object.Object) object.Object {
+			return object.CreateInt(args[0].(object.Int).Value * 2)
+		}},
+	}
+	e := emitter.NewEmitter(available)
+	e.Function("f", []string{"x"}, func(e *emitter.Emitter) error {
+		e.Load("x")
+		e.Load("double")
+		e.Call(1)
+		e.ReturnValue()
+		return nil
+	})
+	e.PushInt(1)
+	e.PushInt(20)
+	e.Load("f")
+	e.Call(1)
+	e.AddInt()
+
+	vm, err := NewVM(e.Bytecode(), available)
+	assert.NoError(t, err)
+	err = vm.Run()
+	assert.NoError(t, err)
+	assert.Equal(t, object.Object(object.CreateInt(41)), vm.Peek())
+}
+
+func TestTailCall_Caught(t *testing.T) {
+	e := emitter.NewEmitter(builtins)
+	e.Function("fail", []string{}, func(e *emitter.Emitter) error {
+		e.PushString("failed")
+		e.Throw()
+		return nil
+	})
+	e.Function("f", []string{}, func(e *emitter.Emitter) error {
+		e.Load("fail")
+		e.Call(0)
+		e.ReturnValue()
+		return nil
+	})
+	e.Try(func(e *emitter.Emitter) error {
+		e.Load("f")
+		e.Call(0)
+		e.Store("result")
+		return nil
+	}, "err", func(e *emitter.Emitter) error {
+		e.Load("err")
+		e.Store("result")
+		return nil
+	}, nil)
+	e.Load("result")
+
+	testVM(t, e, object.CreateString("failed"))
+}
+
+// --------------------------------------------
+// Array Tests
+// --------------------------------------------
+
+// simple integer array creation
+func TestArrayBasic(t *testing.T) {
+	e := emitter.NewEmitter(builtins)
+	e.PushInt(1)
+	e.PushInt(2)
+	e.PushInt(3)
+	e.Array(3)
+
+	expected := object.CreateArray([]object.Object{
+		object.CreateInt(1),
+		object.CreateInt(2),
+		object.CreateInt(3),
+	})
+	testVM(t, e, expected)
+}
+
+// array indexing
+func TestArrayIndex(t *testing.T) {
+	e := emitter.NewEmitter(builtins)
+	e.PushInt(10)
+	e.PushInt(20)
+	e.PushInt(30)
 	e.Array(3)
 
-	e.PushInt(1) // index
+	e.PushInt(1) // index
+	e.Index()
+
+	expected := object.CreateInt(20)
+	testVM(t, e, expected)
+}
+
+// nested arrays
+func TestNestedArrays(t *testing.T) {
+	e := emitter.NewEmitter(builtins)
+	e.PushInt(1)
+	e.PushInt(2)
+	e.Array(2) // [1,2]
+	e.PushInt(3)
+	e.Array(2) // [[1,2],3]
+
+	expected := object.CreateArray([]object.Object{
+		object.CreateArray([]object.Object{
+			object.CreateInt(1),
+			object.CreateInt(2),
+		}),
+		object.CreateInt(3),
+	})
+	testVM(t, e, expected)
+}
+
+// array with globals
+func TestArrayWithGlobal(t *testing.T) {
+	e := emitter.NewEmitter(builtins)
+	e.PushInt(42)
+	e.Store("x")
+
+	e.Load("x")
+	e.PushInt(99)
+	e.Array(2)
+	e.Store("arr")
+	e.Load("arr")
+
+	expected := object.CreateArray([]object.Object{
+		object.CreateInt(42),
+		object.CreateInt(99),
+	})
+	testVM(t, e, expected)
+}
+
+// reuse array after mutation (conceptually re-store)
+func TestArrayOverwriteGlobal(t *testing.T) {
+	e := emitter.NewEmitter(builtins)
+	e.PushInt(1)
+	e.PushInt(2)
+	e.Array(2)
+	e.Store("a")
+
+	e.PushInt(100)
+	e.PushInt(200)
+	e.Array(2)
+	e.Store("a")
+
+	e.Load("a")
+
+	expected := object.CreateArray([]object.Object{
+		object.CreateInt(100),
+		object.CreateInt(200),
+	})
+	testVM(t, e, expected)
+}
+
+// --------------------------------------------
+// Hash Tests
+// --------------------------------------------
+
+// basic hash creation
+func TestHashBasic(t *testing.T) {
+	e := emitter.NewEmitter(builtins)
+	e.PushString("x")
+	e.PushInt(10)
+	e.PushString("y")
+	e.PushInt(20)
+	e.Hash(2)
+
+	expected := object.CreateHash(map[object.Object]object.Object{
+		object.CreateString("x"): object.CreateInt(10),
+		object.CreateString("y"): object.CreateInt(20),
+	})
+	testVM(t, e, expected)
+}
+
+// // hash index by string key
+func TestHashIndex(t *testing.T) {
+	e := emitter.NewEmitter(builtins)
+	e.PushString("age")
+	e.PushInt(27)
+	e.Hash(1)
+
+	e.PushString("age")
+	e.Access()
+
+	expected := object.CreateInt(27)
+	testVM(t, e, expected)
+}
+
+// // nested hash inside array
+func TestArrayOfHashes(t *testing.T) {
+	e := emitter.NewEmitter(builtins)
+	e.PushString("a")
+	e.PushInt(1)
+	e.Hash(1)
+	e.PushString("b")
+	e.PushInt(2)
+	e.Hash(1)
+	e.Array(2)
+
+	expected := object.CreateArray([]object.Object{
+		object.CreateHash(
+			map[object.Object]object.Object{
+				object.CreateString("a"): object.CreateInt(1),
+			}),
+		object.CreateHash(
+			map[object.Object]object.Object{
+				object.CreateString("b"): object.CreateInt(2),
+			}),
+	})
+	testVM(t, e, expected)
+}
+
+// // hash with globals and index lookup
+func TestHashGlobalAndIndex(t *testing.T) {
+	e := emitter.NewEmitter(builtins)
+	e.PushString("x")
+	e.PushInt(5)
+	e.PushString("y")
+	e.PushInt(10)
+	e.Hash(2)
+	e.Store("h")
+
+	e.Load("h")
+	e.PushString("y")
+	e.Access()
+
+	expected := object.CreateInt(10)
+	testVM(t, e, expected)
+}
+
+// // hash inside hash
+func TestNestedHash(t *testing.T) {
+	e := emitter.NewEmitter(builtins)
+	e.PushString("outer")
+	e.PushString("inner")
+	e.PushInt(123)
+	e.Hash(1)
+
+	e.Hash(1)
+
+	expected := object.CreateHash(map[object.Object]object.Object{
+		object.CreateString("outer"): object.CreateHash(map[object.Object]object.Object{
+			object.CreateString("inner"): object.CreateInt(123),
+		}),
+	})
+	testVM(t, e, expected)
+}
+
+func TestToFloat(t *testing.T) {
+	e := emitter.NewEmitter(builtins)
+	e.PushInt(3)
+	e.ToFloat()
+
+	expected := object.CreateFloat(3)
+
+	testVM(t, e, expected)
+}
+
+func TestPrint(t *testing.T) {
+	e := emitter.NewEmitter(builtins)
+	e.PushString("hello, world")
+	e.Load("print")
+	e.Call(1)
+
+	testVMStackEmpty(t, e)
+}
+
+// Add other builtins
+
+// TODO: len
+// TODO: push
+// TODO: pop
+// TODO: sqrt
+// TODO: exp
+// TODO: min
+// TODO: min/max
+// TODO: string
+// TODO: lowercase
+// TODO: uppercase
+// TODO: count
+// TODO: type (most important)
+// TODO: exit
+
+func TestAssignment(t *testing.T) {
+	e := emitter.NewEmitter(builtins)
+	e.PushString("some value")
+	e.Store("x")
+	e.PushString("some other value")
+	e.Store("x")
+	e.PushString("some stack value")
+	e.Load("x")
+
+	expected := object.CreateString("some other value")
+
+	testVM(t, e, expected)
+}
+
+func TestPop(t *testing.T) {
+	e := emitter.NewEmitter(builtins)
+	e.PushInt(1)
+	e.PushInt(2)
+	e.Pop()
+
+	testVM(t, e, object.CreateInt(1))
+}
+
+func TestDup(t *testing.T) {
+	e := emitter.NewEmitter(builtins)
+	e.PushInt(3)
+	e.Dup()
+	e.MulInt()
+
+	testVM(t, e, object.CreateInt(9))
+}
+
+func TestSwap(t *testing.T) {
+	e := emitter.NewEmitter(builtins)
+	e.PushInt(1)
+	e.PushInt(5)
+	e.Swap()
+	e.SubInt()
+
+	testVM(t, e, object.CreateInt(4))
+}
+
+func TestDupIndexUpdate(t *testing.T) {
+	// a[0] + 1, evaluating the array expression only once.
+	e := emitter.NewEmitter(builtins)
+	e.PushInt(41)
+	e.Array(1)
+	e.Dup()
+	e.PushInt(0)
 	e.Index()
+	e.PushInt(1)
+	e.AddInt()
+	e.Swap()
+	e.Pop()
+
+	testVM(t, e, object.CreateInt(42))
+}
+
+func TestPop_StackConstantInLoop(t *testing.T) {
+	e := emitter.NewEmitter(builtins)
+	e.PushInt(0)
+	e.Store("i")
+
+	e.While(
+		func(e *emitter.Emitter) error {
+			e.Load("i")
+			e.PushInt(10000)
+			e.LtInt()
+			return nil
+		},
+		func(e *emitter.Emitter) error {
+			// Expression statements, whose results are unused.
+			e.Load("i")
+			e.PushInt(2)
+			e.MulInt()
+			e.Pop()
+
+			e.PushString("unused")
+			e.Pop()
+
+			// i = i + 1, leaving the new value as the expression result.
+			e.Load("i")
+			e.PushInt(1)
+			e.AddInt()
+			e.Dup()
+			e.Store("i")
+			e.Pop()
+			return nil
+		},
+	)
+
+	testVMStackEmpty(t, e)
+}
+
+func TestTry_CatchThrown(t *testing.T) {
+	e := emitter.NewEmitter(builtins)
+	e.Try(
+		func(e *emitter.Emitter) error {
+			e.PushString("boom")
+			e.Throw()
+			return nil
+		},
+		"err",
+		func(e *emitter.Emitter) error {
+			e.Load("err")
+			e.Store("result")
+			return nil
+		},
+		nil,
+	)
+	e.Load("result")
+
+	testVM(t, e, object.CreateString("boom"))
+}
+
+func TestTry_NoThrow(t *testing.T) {
+	e := emitter.NewEmitter(builtins)
+	e.PushInt(1)
+	e.Store("result")
+	e.Try(
+		func(e *emitter.Emitter) error {
+			e.PushInt(2)
+			e.Store("result")
+			return nil
+		},
+		"err",
+		func(e *emitter.Emitter) error {
+			e.PushInt(3)
+			e.Store("result")
+			return nil
+		},
+		nil,
+	)
+	e.Load("result")
+
+	testVM(t, e, object.CreateInt(2))
+}
+
+func TestTry_DivisionByZero(t *testing.T) {
+	e := emitter.NewEmitter(builtins)
+	e.Try(
+		func(e *emitter.Emitter) error {
+			e.PushInt(1)
+			e.PushInt(0)
+			e.DivInt()
+			e.Store("result")
+			return nil
+		},
+		"err",
+		func(e *emitter.Emitter) error {
+			e.Load("err")
+			e.Store("result")
+			return nil
+		},
+		nil,
+	)
+	e.Load("result")
+
+	testVM(t, e, object.Error{Message: "Division by zero"})
+}
+
+func TestTry_UnwindFrames(t *testing.T) {
+	e := emitter.NewEmitter(builtins)
+	e.Function("outer", []string{}, func(e *emitter.Emitter) error {
+		e.Function("inner", []string{}, func(e *emitter.Emitter) error {
+			e.PushInt(1)
+			e.Array(1)
+			e.PushInt(5)
+			e.Index()
+			e.ReturnValue()
+			return nil
+		})
+		e.PushInt(100)
+		e.Load("inner")
+		e.Call(0)
+		e.AddInt()
+		e.ReturnValue()
+		return nil
+	})
+	e.Try(
+		func(e *emitter.Emitter) error {
+			e.Load("outer")
+			e.Call(0)
+			e.Store("result")
+			return nil
+		},
+		"err",
+		func(e *emitter.Emitter) error {
+			e.Load("err")
+			e.Store("result")
+			return nil
+		},
+		nil,
+	)
+	e.Load("result")
+
+	testVM(t, e, object.Error{Message: "Index out of range: 5 with length 1"})
+}
+
+func TestTry_RestoresStack(t *testing.T) {
+	e := emitter.NewEmitter(builtins)
+	e.Try(
+		func(e *emitter.Emitter) error {
+			e.PushInt(1)
+			e.PushInt(2)
+			e.PushInt(3)
+			e.Throw()
+			return nil
+		},
+		"",
+		func(e *emitter.Emitter) error {
+			return nil
+		},
+		nil,
+	)
+
+	testVMStackEmpty(t, e)
+}
+
+func markFinally(e *emitter.Emitter) error {
+	e.Load("finally")
+	e.PushInt(1)
+	e.AddInt()
+	e.Store("finally")
+	return nil
+}
+
+func TestTry_FinallyNormal(t *testing.T) {
+	e := emitter.NewEmitter(builtins)
+	e.PushInt(0)
+	e.Store("finally")
+	e.Try(
+		func(e *emitter.Emitter) error {
+			e.PushInt(1)
+			e.Pop()
+			return nil
+		},
+		"err",
+		func(e *emitter.Emitter) error {
+			return nil
+		},
+		markFinally,
+	)
+	e.Load("finally")
+
+	testVM(t, e, object.CreateInt(1))
+}
+
+func TestTry_FinallyAfterCatch(t *testing.T) {
+	e := emitter.NewEmitter(builtins)
+	e.PushInt(0)
+	e.Store("finally")
+	e.Try(
+		func(e *emitter.Emitter) error {
+			e.PushInt(1)
+			e.Throw()
+			return nil
+		},
+		"err",
+		func(e *emitter.Emitter) error {
+			return nil
+		},
+		markFinally,
+	)
+	e.Load("finally")
+
+	testVM(t, e, object.CreateInt(1))
+}
+
+func TestTry_FinallyRethrows(t *testing.T) {
+	e := emitter.NewEmitter(builtins)
+	e.PushInt(0)
+	e.Store("finally")
+	e.Try(
+		func(e *emitter.Emitter) error {
+			return e.Try(
+				func(e *emitter.Emitter) error {
+					e.PushString("inner")
+					e.Throw()
+					return nil
+				},
+				"",
+				nil,
+				markFinally,
+			)
+		},
+		"err",
+		func(e *emitter.Emitter) error {
+			e.Load("err")
+			e.Store("result")
+			return nil
+		},
+		nil,
+	)
+	e.Load("finally")
+	e.Load("result")
+	e.Array(2)
+
+	testVM(t, e, object.Array{Values: []object.Object{
+		object.CreateInt(1),
+		object.CreateString("inner"),
+	}})
+}
+
+func TestTry_HandlerThrows(t *testing.T) {
+	e := emitter.NewEmitter(builtins)
+	e.PushInt(0)
+	e.Store("finally")
+	e.Try(
+		func(e *emitter.Emitter) error {
+			return e.Try(
+				func(e *emitter.Emitter) error {
+					e.PushString("first")
+					e.Throw()
+					return nil
+				},
+				"err",
+				func(e *emitter.Emitter) error {
+					e.PushString("second")
+					e.Throw()
+					return nil
+				},
+				markFinally,
+			)
+		},
+		"err",
+		func(e *emitter.Emitter) error {
+			e.Load("err")
+			e.Store("result")
+			return nil
+		},
+		nil,
+	)
+	e.Load("finally")
+	e.Load("result")
+	e.Array(2)
+
+	testVM(t, e, object.Array{Values: []object.Object{
+		object.CreateInt(1),
+		object.CreateString("second"),
+	}})
+}
+
+func TestTry_BreakRunsFinally(t *testing.T) {
+	e := emitter.NewEmitter(builtins)
+	e.PushInt(0)
+	e.Store("finally")
+	e.Loop(func(e *emitter.Emitter) error {
+		return e.Try(
+			func(e *emitter.Emitter) error {
+				e.Break()
+				return nil
+			},
+			"",
+			nil,
+			markFinally,
+		)
+	})
+	e.Load("finally")
+
+	bytecode := e.Bytecode()
+	assert.Equal(t, 0, len(e.Errors()))
+
+	vm, err := NewVM(bytecode, builtins)
+	assert.NoError(t, err)
+	err = vm.Run()
+	assert.NoError(t, err)
+
+	assert.Equal(t, object.CreateInt(1), vm.Peek())
+	assert.Equal(t, 0, len(vm.handlers), "Handlers not popped!")
+}
+
+func TestTry_ReturnRunsFinally(t *testing.T) {
+	e := emitter.NewEmitter(builtins)
+	e.PushInt(0)
+	e.Store("finally")
+	e.Function("f", []string{}, func(e *emitter.Emitter) error {
+		return e.Try(
+			func(e *emitter.Emitter) error {
+				e.PushInt(42)
+				e.ReturnValue()
+				return nil
+			},
+			"",
+			nil,
+			markFinally,
+		)
+	})
+	e.Load("f")
+	e.Call(0)
+	e.Load("finally")
+	e.Array(2)
+
+	testVM(t, e, object.Array{Values: []object.Object{
+		object.CreateInt(42),
+		object.CreateInt(1),
+	}})
+}
+
+func TestError_TypeMismatch(t *testing.T) {
+	e := emitter.NewEmitter(builtins)
+	e.PushInt(1)
+	e.PushString("a")
+	e.AddInt()
+
+	err := testVMError(t, e, "Expected object to be Integer, got a")
+	assert.Equal(t, code.ADD_INT, err.Op)
+	assert.Equal(t, 2, err.IP)
+	assert.Equal(t, 1, err.Depth)
+}
+
+func TestError_Uncaught(t *testing.T) {
+	e := emitter.NewEmitter(builtins)
+	e.PushString("boom")
+	e.Throw()
+
+	err := testVMError(t, e, "Uncaught exception: boom")
+	assert.Equal(t, object.Object(object.CreateString("boom")), err.Value)
+}
+
+func TestError_StackUnderflow(t *testing.T) {
+	e := emitter.NewEmitter(builtins)
+	e.Pop()
+
+	testVMError(t, e, "Stack underflow!")
+}
+
+// TestStackEffects executes every instruction with a fixed stack effect, and checks it against its definition.
+func TestStackEffects(t *testing.T) {
+	one := object.CreateInt(1)
+	half := object.CreateFloat(0.5)
+	yes := object.CreateBool(true)
+	name := object.CreateString("a")
+	array := object.CreateArray([]object.Object{one})
+	hash := object.Hash{Values: map[object.Object]object.Object{name: one}}
+
+	// The end of the tape, for jumps.
+	end := func(inputs int) int { return inputs + 1 }
+
+	tests := map[code.Op]struct {
+		args   []int
+		inputs []object.Object
+		// before runs ahead of the inputs, without affecting the stack.
+		before []code.Instruction
+	}{
+		code.PUSH:            {args: []int{0}, inputs: []object.Object{}},
+		code.ADD_INT:         {inputs: []object.Object{one, one}},
+		code.SUB_INT:         {inputs: []object.Object{one, one}},
+		code.MUL_INT:         {inputs: []object.Object{one, one}},
+		code.DIV_INT:         {inputs: []object.Object{one, one}},
+		code.LT_INT:          {inputs: []object.Object{one, one}},
+		code.LTE_INT:         {inputs: []object.Object{one, one}},
+		code.GT_INT:          {inputs: []object.Object{one, one}},
+		code.GTE_INT:         {inputs: []object.Object{one, one}},
+		code.ADD_FLOAT:       {inputs: []object.Object{half, half}},
+		code.SUB_FLOAT:       {inputs: []object.Object{half, half}},
+		code.MUL_FLOAT:       {inputs: []object.Object{half, half}},
+		code.DIV_FLOAT:       {inputs: []object.Object{half, half}},
+		code.LT_FLOAT:        {inputs: []object.Object{half, half}},
+		code.LTE_FLOAT:       {inputs: []object.Object{half, half}},
+		code.GT_FLOAT:        {inputs: []object.Object{half, half}},
+		code.GTE_FLOAT:       {inputs: []object.Object{half, half}},
+		code.AND_BOOL:        {inputs: []object.Object{yes, yes}},
+		code.OR_BOOL:         {inputs: []object.Object{yes, yes}},
+		code.EQ:              {inputs: []object.Object{one, one}},
+		code.NEQ:             {inputs: []object.Object{one, one}},
+		code.ADD_STRING:      {inputs: []object.Object{name, name}},
+		code.JUMP:            {args: []int{end(0)}, inputs: []object.Object{}},
+		code.JUMP_FALSE:      {args: []int{end(1)}, inputs: []object.Object{yes}},
+		code.JUMP_TRUE:       {args: []int{end(1)}, inputs: []object.Object{yes}},
+		code.STORE_GLOBAL:    {args: []int{0}, inputs: []object.Object{one}},
+		code.STORE_LOCAL:     {args: []int{0}, inputs: []object.Object{one}},
+		code.STORE_FREE:      {args: []int{0}, inputs: []object.Object{one}},
+		code.DEFINE_LOCAL:    {args: []int{0}, inputs: []object.Object{}},
+		code.LOAD_GLOBAL:     {args: []int{0}, inputs: []object.Object{}},
+		code.LOAD_LOCAL:      {args: []int{0}, inputs: []object.Object{}},
+		code.LOAD_FREE:       {args: []int{0}, inputs: []object.Object{}},
+		code.CURRENT_CLOSURE: {inputs: []object.Object{}},
+		code.CAPTURE_LOCAL:   {args: []int{0}, inputs: []object.Object{}},
+		code.CAPTURE_FREE:    {args: []int{0}, inputs: []object.Object{}},
+		code.ARRAY:           {args: []int{2}, inputs: []object.Object{one, one}},
+		code.HASH:            {args: []int{1}, inputs: []object.Object{name, one}},
+		code.INDEX:           {inputs: []object.Object{array, object.CreateInt(0)}},
+		code.ACCESS:          {inputs: []object.Object{hash, name}},
+		code.LEN:             {inputs: []object.Object{array}},
+		code.ITER:            {inputs: []object.Object{hash}},
+		code.NOT:             {inputs: []object.Object{yes}},
+		code.NEGATE_INT:      {inputs: []object.Object{one}},
+		code.NEGATE_FLOAT:    {inputs: []object.Object{half}},
+		code.TO_FLOAT:        {inputs: []object.Object{one}},
+		code.CLASS:           {inputs: []object.Object{name}},
+		code.BUILTIN:         {args: []int{0}, inputs: []object.Object{}},
+		code.POP:             {inputs: []object.Object{one}},
+		code.DUP:             {inputs: []object.Object{one}},
+		code.SWAP:            {inputs: []object.Object{one, one}},
+		code.SETUP_TRY:       {args: []int{0}, inputs: []object.Object{}},
+		code.POP_TRY:         {inputs: []object.Object{}, before: []code.Instruction{{OpCode: code.SETUP_TRY, Args: []int{0}}}},
+	}
+	// These leave the frame or unwind the stack, or their effect depends on the called function or on the constant pool.
+	skipped := []code.Op{code.RETURN, code.RETURN_VALUE, code.THROW, code.CALL, code.CALL_KW, code.TAIL_CALL, code.CLOSURE}
+
+	for op := code.Op(1); op.String() != fmt.Sprintf("Op(%d)", op); op++ {
+		test, ok := tests[op]
+		if !ok {
+			assert.True(t, slices.Contains(skipped, op), "No stack effect test for %s", op)
+			continue
+		}
+
+		ins := code.Instruction{OpCode: op, Args: test.args}
+		pops, pushes, err := code.StackEffect(ins)
+		assert.NoError(t, err)
+		assert.NotEqual(t, code.Variable, pops, "Pops of %s", op)
+		assert.NotEqual(t, code.Variable, pushes, "Pushes of %s", op)
+
+		tape := slices.Clone(test.before)
+		for i := range test.inputs {
+			tape = append(tape, code.Instruction{OpCode: code.PUSH, Args: []int{i}})
+		}
+		tape = append(tape, ins)
+
+		// PUSH pushes the constant after the inputs.
+		constants := append(slices.Clone(test.inputs), one)
+		vm, err := NewVM(emitter.ByteCode{Tape: tape, Constants: constants, Builtins: []string{"print"}}, builtins)
+		assert.NoError(t, err)
+		vm.globals[0] = one
+		vm.frames[0].locals = []object.Object{one}
+		vm.frames[0].free = []*object.Cell{{Value: one}}
+
+		// run skips the validation, as the main program has no locals and no free variables.
+		assert.Zero(t, vm.run(), "Running %s", op)
+		assert.Equal(t, len(test.inputs)-pops+pushes, vm.stackPointer, "Stack effect of %s", op)
+	}
+}
+
+func TestError_InvalidOp(t *testing.T) {
+	e := emitter.NewEmitter(builtins)
+	e.Emit(code.Op(255))
+
+	testVMError(t, e, "Invalid Op at 0: Op(255)")
+}
+
+func TestError_MissingOperand(t *testing.T) {
+	e := emitter.NewEmitter(builtins)
+	e.Function("f", []string{}, func(e *emitter.Emitter) error {
+		e.Emit(code.ARRAY)
+		e.ReturnValue()
+		return nil
+	})
 
-	expected := object.CreateInt(20)
-	testVM(t, e, expected)
+	err := testVMError(t, e, "Malformed ARRAY at 0: expected 1 operands, got 0")
+	assert.Equal(t, code.ARRAY, err.Op)
+	assert.Equal(t, []TraceEntry{{Name: "f", Op: code.ARRAY, IP: 0}}, err.Trace)
 }
 
-// nested arrays
-func TestNestedArrays(t *testing.T) {
+func TestError_Arity(t *testing.T) {
 	e := emitter.NewEmitter(builtins)
+	e.Function("add", []string{"x", "y"}, func(e *emitter.Emitter) error {
+		e.Load("x")
+		e.Load("y")
+		e.AddInt()
+		e.ReturnValue()
+		return nil
+	})
 	e.PushInt(1)
-	e.PushInt(2)
-	e.Array(2) // [1,2]
-	e.PushInt(3)
-	e.Array(2) // [[1,2],3]
+	e.Load("add")
+	e.Call(1)
 
-	expected := object.CreateArray([]object.Object{
-		object.CreateArray([]object.Object{
-			object.CreateInt(1),
-			object.CreateInt(2),
-		}),
-		object.CreateInt(3),
-	})
-	testVM(t, e, expected)
+	err := testVMError(t, e, "add expects 2 arguments, got 1")
+	assert.Equal(t, code.CALL, err.Op)
+	assert.Equal(t, 1, err.Depth)
 }
 
-// array with globals
-func TestArrayWithGlobal(t *testing.T) {
+func TestError_ParamsArity(t *testing.T) {
 	e := emitter.NewEmitter(builtins)
-	e.PushInt(42)
-	e.Store("x")
+	e.PushInt(80)
+	e.Store("defaultPort")
+	connect(e)
+	e.Load("connect")
+	e.Call(0)
 
-	e.Load("x")
-	e.PushInt(99)
-	e.Array(2)
-	e.Store("arr")
-	e.Load("arr")
+	testVMError(t, e, "connect expects at least 1 arguments, got 0")
 
-	expected := object.CreateArray([]object.Object{
-		object.CreateInt(42),
-		object.CreateInt(99),
+	e = emitter.NewEmitter(builtins)
+	e.FunctionWithParams("f", emitter.Params{
+		Required: []string{"x"},
+		Optional: []emitter.Optional{{Name: "y"}, {Name: "z"}},
+	}, func(e *emitter.Emitter) error {
+		return nil
 	})
-	testVM(t, e, expected)
+	for range 4 {
+		e.PushInt(1)
+	}
+	e.Load("f")
+	e.Call(4)
+
+	testVMError(t, e, "f expects 1 to 3 arguments, got 4")
 }
 
-// reuse array after mutation (conceptually re-store)
-func TestArrayOverwriteGlobal(t *testing.T) {
-	e := emitter.NewEmitter(builtins)
-	e.PushInt(1)
-	e.PushInt(2)
-	e.Array(2)
-	e.Store("a")
+func TestError_BuiltinArity(t *testing.T) {
+	echo := func(args ...object.Object) object.Object {
+		return object.CreateInt(len(args))
+	}
+	tests := []struct {
+		arity    *object.Arity
+		numArgs  int
+		expected string
+	}{
+		{&object.Arity{Min: 1, Max: 1}, 2, "echo expects 1 arguments, got 2"},
+		{&object.Arity{Min: 1, Max: 3}, 0, "echo expects 1 to 3 arguments, got 0"},
+		{&object.Arity{Min: 2, Max: object.Variadic}, 1, "echo expects at least 2 arguments, got 1"},
+		{&object.Arity{Min: 2, Max: object.Variadic}, 5, ""},
+		{&object.Arity{Min: 1, Max: 3}, 3, ""},
+		{nil, 4, ""},
+	}
 
-	e.PushInt(100)
-	e.PushInt(200)
-	e.Array(2)
-	e.Store("a")
+	for _, test := range tests {
+		available := map[string]object.Builtin{
+			"echo": {Internal: echo, Arity: test.arity},
+		}
+		e := emitter.NewEmitter(available)
+		for i := range test.numArgs {
+			e.PushInt(i)
+		}
+		e.Load("echo")
+		e.Call(test.numArgs)
 
-	e.Load("a")
+		vm, err := NewVM(e.Bytecode(), available)
+		assert.NoError(t, err)
 
-	expected := object.CreateArray([]object.Object{
-		object.CreateInt(100),
-		object.CreateInt(200),
-	})
-	testVM(t, e, expected)
+		err = vm.Run()
+		if test.expected == "" {
+			assert.NoError(t, err)
+			assert.Equal(t, object.Object(object.CreateInt(test.numArgs)), vm.Peek())
+			continue
+		}
+
+		runtimeErr, ok := err.(*RuntimeError)
+		assert.True(t, ok, "Expected a RuntimeError!")
+		assert.Equal(t, test.expected, runtimeErr.Message)
+	}
 }
 
-// --------------------------------------------
-// Hash Tests
-// --------------------------------------------
+func TestUnknownArity(t *testing.T) {
+	// Functions decoded from version 1 files have no arity, calls to them aren't checked.
+	bytecode := emitter.ByteCode{
+		Tape: []code.Instruction{
+			{OpCode: code.PUSH, Args: []int{1}},
+			{OpCode: code.CLOSURE, Args: []int{0, 0}},
+			{OpCode: code.CALL, Args: []int{1}},
+		},
+		Constants: []object.Object{
+			object.Function{
+				Value: []code.Instruction{
+					{OpCode: code.LOAD_LOCAL, Args: []int{0}},
+					{OpCode: code.RETURN_VALUE},
+				},
+				NumLocals:    1,
+				UnknownArity: true,
+			},
+			object.CreateInt(42),
+		},
+	}
 
-// basic hash creation
-func TestHashBasic(t *testing.T) {
-	e := emitter.NewEmitter(builtins)
-	e.PushString("x")
-	e.PushInt(10)
-	e.PushString("y")
-	e.PushInt(20)
-	e.Hash(2)
+	vm, err := NewVM(bytecode, builtins)
+	assert.NoError(t, err)
+	assert.NoError(t, vm.Run())
+	assert.Equal(t, object.Object(object.CreateInt(42)), vm.Peek())
+}
 
-	expected := object.CreateHash(map[object.Object]object.Object{
-		object.CreateString("x"): object.CreateInt(10),
-		object.CreateString("y"): object.CreateInt(20),
+func TestError_LocalOutOfRange(t *testing.T) {
+	e := emitter.NewEmitter(builtins)
+	e.Constant(object.Function{
+		Name:      "f",
+		Arity:     1,
+		NumLocals: 2,
+		Value: []code.Instruction{
+			{OpCode: code.LOAD_LOCAL, Args: []int{0}},
+			{OpCode: code.LOAD_LOCAL, Args: []int{2}},
+		},
+		Lines: code.LineTable{
+			{Offset: 1, Position: code.Position{File: "f.fen", Line: 2, Col: 3}},
+		},
 	})
-	testVM(t, e, expected)
+
+	err := testVMError(t, e, "Local 2 at 1 is out of range, f has 2 locals")
+	assert.Equal(t, code.LOAD_LOCAL, err.Op)
+	assert.Equal(t, 1, err.IP)
+	assert.Equal(t, 0, err.Depth)
+	assert.Equal(t, []TraceEntry{{Name: "f", Op: code.LOAD_LOCAL, IP: 1, Position: err.Position}}, err.Trace)
+	assert.Equal(t, "f.fen:2:3: Local 2 at 1 is out of range, f has 2 locals (LOAD_LOCAL at 1, depth 0)", err.Error())
 }
 
-// // hash index by string key
-func TestHashIndex(t *testing.T) {
+func TestError_FrameOverflow(t *testing.T) {
 	e := emitter.NewEmitter(builtins)
-	e.PushString("age")
-	e.PushInt(27)
-	e.Hash(1)
-
-	e.PushString("age")
-	e.Access()
+	e.Function("f", []string{}, func(e *emitter.Emitter) error {
+		e.PushInt(1)
+		e.Load("f")
+		e.Call(0)
+		e.AddInt()
+		e.ReturnValue()
+		return nil
+	})
+	e.Load("f")
+	e.Call(0)
 
-	expected := object.CreateInt(27)
-	testVM(t, e, expected)
+	err := testVMError(t, e, "Frame overflow!")
+	assert.Equal(t, MaxFrames, err.Depth)
 }
 
-// // nested hash inside array
-func TestArrayOfHashes(t *testing.T) {
+func TestError_Trace(t *testing.T) {
 	e := emitter.NewEmitter(builtins)
-	e.PushString("a")
-	e.PushInt(1)
-	e.Hash(1)
-	e.PushString("b")
-	e.PushInt(2)
-	e.Hash(1)
-	e.Array(2)
-
-	expected := object.CreateArray([]object.Object{
-		object.CreateHash(
-			map[object.Object]object.Object{
-				object.CreateString("a"): object.CreateInt(1),
-			}),
-		object.CreateHash(
-			map[object.Object]object.Object{
-				object.CreateString("b"): object.CreateInt(2),
-			}),
+	e.Function("inner", []string{}, func(e *emitter.Emitter) error {
+		e.Array(0)
+		e.PushInt(3)
+		e.Index()
+		e.ReturnValue()
+		return nil
 	})
-	testVM(t, e, expected)
+	e.Function("outer", []string{}, func(e *emitter.Emitter) error {
+		e.Load("inner")
+		e.Call(0)
+		e.ReturnValue()
+		return nil
+	})
+	e.Load("outer")
+	e.Call(0)
+
+	// inner is tail called, it replaced the frame of outer.
+	err := testVMError(t, e, "Index out of range: 3 with length 0")
+	assert.Equal(t, 2, err.Depth)
+	assert.Equal(t, []TraceEntry{
+		{Name: "inner", Op: code.INDEX, IP: 2},
+		{Name: "<main>", Op: code.CALL, IP: 5},
+	}, err.Trace)
 }
 
-// // hash with globals and index lookup
-func TestHashGlobalAndIndex(t *testing.T) {
+func TestError_TraceNonTail(t *testing.T) {
 	e := emitter.NewEmitter(builtins)
-	e.PushString("x")
-	e.PushInt(5)
-	e.PushString("y")
-	e.PushInt(10)
-	e.Hash(2)
-	e.Store("h")
-
-	e.Load("h")
-	e.PushString("y")
-	e.Access()
+	e.Function("inner", []string{}, func(e *emitter.Emitter) error {
+		e.Array(0)
+		e.PushInt(3)
+		e.Index()
+		e.ReturnValue()
+		return nil
+	})
+	// outer works on the result, so the call isn't a tail call and outer keeps its frame.
+	e.Function("outer", []string{}, func(e *emitter.Emitter) error {
+		e.Load("inner")
+		e.Call(0)
+		e.PushInt(1)
+		e.AddInt()
+		e.ReturnValue()
+		return nil
+	})
+	e.Load("outer")
+	e.Call(0)
 
-	expected := object.CreateInt(10)
-	testVM(t, e, expected)
+	err := testVMError(t, e, "Index out of range: 3 with length 0")
+	assert.Equal(t, 3, err.Depth)
+	assert.Equal(t, []TraceEntry{
+		{Name: "inner", Op: code.INDEX, IP: 2},
+		{Name: "outer", Op: code.CALL, IP: 1},
+		{Name: "<main>", Op: code.CALL, IP: 5},
+	}, err.Trace)
 }
 
-// // hash inside hash
-func TestNestedHash(t *testing.T) {
+func TestError_Traceback(t *testing.T) {
 	e := emitter.NewEmitter(builtins)
-	e.PushString("outer")
-	e.PushString("inner")
-	e.PushInt(123)
-	e.Hash(1)
+	e.Function("apply", []string{"f"}, func(e *emitter.Emitter) error {
+		e.Load("f")
+		e.Call(0)
+		e.ReturnValue()
+		return nil
+	})
+	e.Lambda([]string{}, func(e *emitter.Emitter) error {
+		e.PushInt(1)
+		e.PushInt(0)
+		e.DivInt()
+		e.ReturnValue()
+		return nil
+	})
+	e.Load("apply")
+	e.Call(1)
 
-	e.Hash(1)
+	err := testVMError(t, e, "Division by zero")
 
-	expected := object.CreateHash(map[object.Object]object.Object{
-		object.CreateString("outer"): object.CreateHash(map[object.Object]object.Object{
-			object.CreateString("inner"): object.CreateInt(123),
-		}),
-	})
-	testVM(t, e, expected)
+	// The lambda is tail called by apply, so apply doesn't show up.
+	expected := `Traceback (most recent call first):
+  in <lambda>, at 2 (DIV_INT)
+  in <main>, at 4 (CALL)
+RuntimeError: Division by zero`
+	assert.Equal(t, expected, err.Traceback())
 }
 
-func TestToFloat(t *testing.T) {
+func TestError_Position(t *testing.T) {
 	e := emitter.NewEmitter(builtins)
-	e.PushInt(3)
-	e.ToFloat()
+	e.SetPosition("main.fen", 1, 1)
+	e.Function("inner", []string{}, func(e *emitter.Emitter) error {
+		e.SetPosition("main.fen", 2, 5)
+		e.PushInt(1)
+		e.PushString("a")
+		e.SetPosition("main.fen", 2, 7)
+		e.AddInt()
+		e.ReturnValue()
+		return nil
+	})
+	e.SetPosition("main.fen", 4, 1)
+	e.Load("inner")
+	e.Call(0)
 
-	expected := object.CreateFloat(3)
+	err := testVMError(t, e, "Expected object to be Integer, got a")
+	assert.Equal(t, code.Position{File: "main.fen", Line: 2, Col: 7}, err.Position)
+	assert.Equal(t, "main.fen:2:7: Expected object to be Integer, got a (ADD_INT at 2, depth 2)", err.Error())
 
-	testVM(t, e, expected)
+	expected := `Traceback (most recent call first):
+  in inner, at main.fen:2:7 (ADD_INT)
+  in <main>, at main.fen:4:1 (CALL)
+RuntimeError: Expected object to be Integer, got a`
+	assert.Equal(t, expected, err.Traceback())
 }
 
-func TestPrint(t *testing.T) {
+func TestError_Caught(t *testing.T) {
 	e := emitter.NewEmitter(builtins)
-	e.PushString("hello, world")
-	e.Load("print")
+	e.Try(
+		func(e *emitter.Emitter) error {
+			e.PushBool(true)
+			e.NegateInt()
+			e.Store("result")
+			return nil
+		},
+		"err",
+		func(e *emitter.Emitter) error {
+			e.Load("err")
+			e.Store("result")
+			return nil
+		},
+		nil,
+	)
+	e.Load("result")
+
+	testVM(t, e, object.Error{Message: "Expected object to be Integer, got true"})
+}
+
+func TestBuiltin_BoundByName(t *testing.T) {
+	compiled := map[string]object.Builtin{
+		"first":  {},
+		"second": {},
+	}
+	e := emitter.NewEmitter(compiled)
+	e.PushInt(2)
+	e.Load("second")
 	e.Call(1)
 
-	testVMStackEmpty(t, e)
+	// Sorted, second would have been bound to the builtin at index 0.
+	vm, err := NewVM(e.Bytecode(), map[string]object.Builtin{
+		"another": {},
+		"second": {Internal: func(args ...object.Object) object.Object {
+			return object.CreateInt(args[0].(object.Int).Value * 10)
+		}},
+	})
+	assert.NoError(t, err)
+
+	err = vm.Run()
+	assert.NoError(t, err)
+	assert.Equal(t, object.Object(object.CreateInt(20)), vm.Peek())
 }
 
-// Add other builtins
+func TestBuiltin_Missing(t *testing.T) {
+	compiled := map[string]object.Builtin{
+		"first":  {},
+		"second": {},
+		"third":  {},
+	}
+	e := emitter.NewEmitter(compiled)
+	e.Load("third")
+	e.Load("print")
+	e.Load("first")
 
-// TODO: len
-// TODO: push
-// TODO: pop
-// TODO: sqrt
-// TODO: exp
-// TODO: min
-// TODO: min/max
-// TODO: string
-// TODO: lowercase
-// TODO: uppercase
-// TODO: count
-// TODO: type (most important)
-// TODO: exit
+	_, err := NewVM(e.Bytecode(), builtins)
+	assert.EqualError(t, err, "Missing builtins: third, first")
+}
 
-func TestAssignment(t *testing.T) {
-	e := emitter.NewEmitter(builtins)
-	e.PushString("some value")
-	e.Store("x")
-	e.PushString("some other value")
-	e.Store("x")
-	e.PushString("some stack value")
-	e.Load("x")
+func TestBuiltin_NotInTable(t *testing.T) {
+	bytecode := emitter.ByteCode{
+		Tape: []code.Instruction{
+			{OpCode: code.BUILTIN, Args: []int{0}},
+		},
+	}
 
-	expected := object.CreateString("some other value")
+	vm, err := NewVM(bytecode, builtins)
+	assert.NoError(t, err)
 
-	testVM(t, e, expected)
+	err = vm.Run()
+	runtimeErr, ok := err.(*RuntimeError)
+	assert.True(t, ok, "Expected a RuntimeError!")
+	assert.Equal(t, "Builtin 0 at 0 is not in the builtin table", runtimeErr.Message)
+	assert.Equal(t, []TraceEntry{{Name: "<main>", Op: code.BUILTIN, IP: 0}}, runtimeErr.Trace)
 }
 
 func TestClass(t *testing.T) {
@@ -1000,6 +3828,7 @@ func TestClass(t *testing.T) {
 }
 
 func testVM(t *testing.T, e *emitter.Emitter, expected object.Object) {
+	bytecode := e.Bytecode()
 	errs := e.Errors()
 
 	if len(errs) != 0 {
@@ -1010,19 +3839,58 @@ func testVM(t *testing.T, e *emitter.Emitter, expected object.Object) {
 		t.Fatal()
 	}
 
-	vm := NewVM(e.Bytecode(), builtins)
+	vm, err := NewVM(bytecode, builtins)
+	assert.NoError(t, err)
 
-	vm.Run()
+	err = vm.Run()
+	assert.NoError(t, err)
 
 	o := vm.Peek()
 	assert.Equal(t, o, expected, "Result not equal!")
 }
 
 func testVMStackEmpty(t *testing.T, e *emitter.Emitter) {
-	vm := NewVM(e.Bytecode(), builtins)
+	vm, err := NewVM(e.Bytecode(), builtins)
+	assert.NoError(t, err)
 
-	vm.Run()
+	err = vm.Run()
+	assert.NoError(t, err)
 
 	assert.Equal(t, vm.stackPointer, 0, "Stack not empty!")
 
 }
+func testVMError(t *testing.T, e *emitter.Emitter, expected string) *RuntimeError {
+	vm, err := NewVM(e.Bytecode(), builtins)
+	assert.NoError(t, err)
+
+	err = vm.Run()
+	assert.Error(t, err)
+
+	runtimeErr, ok := err.(*RuntimeError)
+	assert.True(t, ok, "Expected a RuntimeError!")
+	assert.Equal(t, expected, runtimeErr.Message)
+
+	return runtimeErr
+}
+
+func BenchmarkFibonacci(b *testing.B) {
+	e := emitter.NewEmitter(builtins)
+	fibonacci(e)
+	e.PushInt(20)
+	e.Load("fibonacci")
+	e.Call(1)
+	bytecode := e.Bytecode()
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for range b.N {
+		vm, err := NewVM(bytecode, builtins)
+		if err != nil {
+			b.Fatal(err)
+		}
+		err = vm.Run()
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}